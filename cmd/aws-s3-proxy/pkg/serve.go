@@ -2,8 +2,11 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,16 +16,20 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 
 	echoprom "github.com/labstack/echo-contrib/prometheus"
 	"go.uber.org/automaxprocs/maxprocs"
 
+	"github.com/packethost/aws-s3-proxy/internal/auth"
 	"github.com/packethost/aws-s3-proxy/internal/config"
 	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+	"github.com/packethost/aws-s3-proxy/internal/middleware/basicauth"
 	zapmw "github.com/packethost/aws-s3-proxy/internal/middleware/echo-zap-logger"
 	promMW "github.com/packethost/aws-s3-proxy/internal/middleware/prometheus"
 	"github.com/packethost/aws-s3-proxy/internal/s3"
+	"github.com/packethost/aws-s3-proxy/internal/tlsconfig"
 )
 
 var (
@@ -30,6 +37,22 @@ var (
 	idleTimeout      = 10
 	exitDelayTimeout = 600
 	metricsMW        *echoprom.Prometheus
+
+	defaultNegativeCacheSize = 10000
+	defaultBackfillWorkers   = 4
+	defaultBackfillQueueSize = 1000
+	defaultBackfillTimeout   = time.Hour
+
+	defaultBackfillMemory int64 = 64 << 20
+
+	defaultDiskCacheMaxSize         int64 = 10 << 30
+	defaultDiskCacheRevalidateAfter       = time.Minute
+
+	defaultMemoryCacheMaxObjectSize int64 = 64 << 10
+
+	defaultUploadConcurrency = 5
+
+	defaultRedirectExpiry = 5 * time.Minute
 )
 
 var serveCmd = &cobra.Command{
@@ -52,6 +75,54 @@ func httpFlags() {
 
 	serveCmd.Flags().String("healthcheck-path", "", "path for healthcheck")
 	viperBindFlag("httpopts.healthcheckpath", serveCmd.Flags().Lookup("healthcheck-path"))
+
+	serveCmd.Flags().StringSlice("index-document", []string{"index.html"}, "documents tried in order for paths ending in a slash")
+	viperBindFlag("httpopts.indexdocuments", serveCmd.Flags().Lookup("index-document"))
+
+	serveCmd.Flags().Bool("redirect-to-index", false, "redirect /dir to /dir/ when only its index document exists")
+	viperBindFlag("httpopts.redirecttoindex", serveCmd.Flags().Lookup("redirect-to-index"))
+
+	serveCmd.Flags().String("not-found-document", "", "document in the primary bucket served for missing objects")
+	viperBindFlag("httpopts.notfounddocument", serveCmd.Flags().Lookup("not-found-document"))
+
+	serveCmd.Flags().Bool("listing", false, "list directories without an index document as HTML, or JSON when accepted")
+	viperBindFlag("httpopts.listing", serveCmd.Flags().Lookup("listing"))
+
+	serveCmd.Flags().Bool("enable-upload", false, "toggle authenticated PUT and POST uploads to the primary store")
+	viperBindFlag("httpopts.enableupload", serveCmd.Flags().Lookup("enable-upload"))
+
+	serveCmd.Flags().Bool("enable-delete", false, "toggle authenticated DELETE of objects and, with ?recursive=true, prefixes from the primary store")
+	viperBindFlag("delete.enabled", serveCmd.Flags().Lookup("enable-delete"))
+
+	serveCmd.Flags().String("delete-trash-prefix", "", "move deleted objects under this prefix instead of deleting them, which hides it from clients")
+	viperBindFlag("delete.trashprefix", serveCmd.Flags().Lookup("delete-trash-prefix"))
+
+	serveCmd.Flags().Duration("delete-trash-retention", 0, "how long deleted objects are kept in the trash, 0 to keep them")
+	viperBindFlag("delete.trashretention", serveCmd.Flags().Lookup("delete-trash-retention"))
+}
+
+// set flags used for authenticating requests
+func authFlags() {
+	serveCmd.Flags().String("auth-username", "", "username for basic authentication")
+	viperBindFlag("auth.username", serveCmd.Flags().Lookup("auth-username"))
+
+	serveCmd.Flags().String("auth-password", "", "password for basic authentication")
+	viperBindFlag("auth.password", serveCmd.Flags().Lookup("auth-password"))
+
+	serveCmd.Flags().StringSlice("auth-user", nil, "static user as `user:password`, the password may be an htpasswd hash")
+	viperBindFlag("auth.users", serveCmd.Flags().Lookup("auth-user"))
+
+	serveCmd.Flags().String("auth-htpasswd-file", "", "htpasswd file with users (bcrypt, SHA or apr1), reloaded on change")
+	viperBindFlag("auth.htpasswdfile", serveCmd.Flags().Lookup("auth-htpasswd-file"))
+
+	serveCmd.Flags().String("auth-read-policy", string(auth.PolicyPublic), "policy for GET and HEAD requests: public, authenticated or deny")
+	viperBindFlag("auth.readpolicy", serveCmd.Flags().Lookup("auth-read-policy"))
+
+	serveCmd.Flags().String("auth-write-policy", string(auth.PolicyAuthenticated), "policy for PUT, POST and DELETE requests: public, authenticated or deny")
+	viperBindFlag("auth.writepolicy", serveCmd.Flags().Lookup("auth-write-policy"))
+
+	viperBindEnv("Auth.Username", "BASIC_AUTH_USER")
+	viperBindEnv("Auth.Password", "BASIC_AUTH_PASS")
 }
 
 // set flags used for the http router
@@ -61,6 +132,15 @@ func serverFlags() {
 
 	serveCmd.Flags().String("listen-port", "21080", "port to listen on")
 	viperBindFlag("serveropts.listenport", serveCmd.Flags().Lookup("listen-port"))
+
+	serveCmd.Flags().String("admin-listen-address", "::1", "host address the admin listener binds to")
+	viperBindFlag("serveropts.adminlistenaddress", serveCmd.Flags().Lookup("admin-listen-address"))
+
+	serveCmd.Flags().String("admin-listen-port", "", "port to serve health, readiness and metrics on instead of the main listener, off when unset")
+	viperBindFlag("serveropts.adminlistenport", serveCmd.Flags().Lookup("admin-listen-port"))
+
+	serveCmd.Flags().Bool("pprof", false, "serve runtime profiles under /debug/pprof/ on the admin listener")
+	viperBindFlag("serveropts.pprof", serveCmd.Flags().Lookup("pprof"))
 }
 
 func s3Flags() {
@@ -108,6 +188,14 @@ func s3Flags() {
 		defaultValue string
 		required     bool
 	}{
+		{
+			long:     "type",
+			describe: "store type: s3 or filesystem (default s3)",
+		},
+		{
+			long:     "directory",
+			describe: "root directory of a filesystem store",
+		},
 		{
 			long:     "access-key",
 			describe: "s3 access-key",
@@ -128,6 +216,60 @@ func s3Flags() {
 			long:     "region",
 			describe: "region for bucket",
 		},
+		{
+			long:     "s3-prefix",
+			describe: "prefix prepended to every key in the bucket",
+		},
+		{
+			long:     "credentials",
+			describe: "how requests are signed: static, default, profile, assume-role or web-identity (default static with keys, otherwise default)",
+		},
+		{
+			long:     "profile",
+			describe: "shared config profile",
+		},
+		{
+			long:     "role-arn",
+			describe: "role to assume",
+		},
+		{
+			long:     "external-id",
+			describe: "external ID when assuming the role",
+		},
+		{
+			long:     "role-session-name",
+			describe: "session name when assuming the role",
+		},
+		{
+			long:     "web-identity-token-file",
+			describe: "web identity token file, defaults to AWS_WEB_IDENTITY_TOKEN_FILE",
+		},
+		{
+			long:     "acl",
+			describe: "canned ACL of uploads, none for buckets with ACLs disabled (default public-read)",
+		},
+		{
+			long:     "storage-class",
+			describe: "storage class of uploads, e.g. STANDARD_IA (default the bucket's)",
+		},
+		{
+			long:     "sse",
+			describe: "server side encryption of uploads: AES256 or aws:kms",
+		},
+		{
+			long:     "sse-kms-key-id",
+			describe: "KMS key uploads are encrypted with, implies aws:kms",
+		},
+	}
+	durationFlags := []struct {
+		long         string
+		describe     string
+		defaultValue time.Duration
+	}{
+		{
+			long:     "role-duration",
+			describe: "how long assumed role credentials last, 0 for the STS default",
+		},
 	}
 
 	for _, store := range stores {
@@ -176,6 +318,18 @@ func s3Flags() {
 			viperBindFlag(cfgPath, serveCmd.Flags().Lookup(f))
 		}
 
+		for _, durationFlag := range durationFlags {
+			f := fmt.Sprintf("%s-%s", store, durationFlag.long)
+			cfgPath := fmt.Sprintf("%s.%s",
+				strings.ReplaceAll(store, "-", ""),
+				strings.ReplaceAll(durationFlag.long, "-", ""),
+			)
+
+			serveCmd.Flags().Duration(f, durationFlag.defaultValue, durationFlag.describe)
+
+			viperBindFlag(cfgPath, serveCmd.Flags().Lookup(f))
+		}
+
 		for _, stringFlag := range stringFlags {
 			f := fmt.Sprintf("%s-%s", store, stringFlag.long)
 
@@ -199,6 +353,126 @@ func s3Flags() {
 	// Secondary bucket flags
 	serveCmd.Flags().Bool("secondary-fall-back", false, "toggle read from secondary")
 	viperBindFlag("readthrough.enabled", serveCmd.Flags().Lookup("secondary-fall-back"))
+
+	serveCmd.Flags().String("secondary-fall-back-policy", string(s3.FallbackNotFound), "primary errors read from secondary: not-found, not-found-and-5xx or all")
+	viperBindFlag("readthrough.fallbackpolicy", serveCmd.Flags().Lookup("secondary-fall-back-policy"))
+
+	serveCmd.Flags().Duration("secondary-negative-cache-ttl", 0, "how long keys missing from both stores are remembered, 0 to disable")
+	viperBindFlag("readthrough.negativecachettl", serveCmd.Flags().Lookup("secondary-negative-cache-ttl"))
+
+	serveCmd.Flags().Int("secondary-negative-cache-size", defaultNegativeCacheSize, "most keys missing from both stores remembered")
+	viperBindFlag("readthrough.negativecachesize", serveCmd.Flags().Lookup("secondary-negative-cache-size"))
+
+	serveCmd.Flags().Bool("cache-to-primary", false, "toggle copying objects read from secondary into primary")
+	viperBindFlag("readthrough.cachetoprimary", serveCmd.Flags().Lookup("cache-to-primary"))
+
+	serveCmd.Flags().Int("cache-to-primary-workers", defaultBackfillWorkers, "how many objects are copied into primary at once")
+	viperBindFlag("readthrough.backfillworkers", serveCmd.Flags().Lookup("cache-to-primary-workers"))
+
+	serveCmd.Flags().Int("cache-to-primary-queue-size", defaultBackfillQueueSize, "how many objects may wait to be copied into primary")
+	viperBindFlag("readthrough.backfillqueuesize", serveCmd.Flags().Lookup("cache-to-primary-queue-size"))
+
+	serveCmd.Flags().Int64("cache-to-primary-max-size", 0, "largest object in bytes copied from secondary to primary, 0 for no limit")
+	viperBindFlag("readthrough.maxcachesize", serveCmd.Flags().Lookup("cache-to-primary-max-size"))
+
+	serveCmd.Flags().Duration("cache-to-primary-timeout", defaultBackfillTimeout, "how long copying a downloaded object into primary may take, 0 for no limit")
+	viperBindFlag("readthrough.backfilltimeout", serveCmd.Flags().Lookup("cache-to-primary-timeout"))
+
+	serveCmd.Flags().Int64("cache-to-primary-memory", defaultBackfillMemory, "most bytes of downloads held in memory until they are copied into primary")
+	viperBindFlag("readthrough.backfillmemory", serveCmd.Flags().Lookup("cache-to-primary-memory"))
+
+	serveCmd.Flags().String("cache-to-primary-spool-dir", "", "directory to spool downloads past the memory limit until they are copied into primary")
+	viperBindFlag("readthrough.spooldir", serveCmd.Flags().Lookup("cache-to-primary-spool-dir"))
+}
+
+// set flags for the local disk cache
+func diskCacheFlags() {
+	serveCmd.Flags().String("disk-cache-dir", "", "directory to cache whole objects in, off when unset")
+	viperBindFlag("diskcache.directory", serveCmd.Flags().Lookup("disk-cache-dir"))
+
+	serveCmd.Flags().Int64("disk-cache-max-size", defaultDiskCacheMaxSize, "most bytes of objects kept in the disk cache")
+	viperBindFlag("diskcache.maxsize", serveCmd.Flags().Lookup("disk-cache-max-size"))
+
+	serveCmd.Flags().String("disk-cache-policy", string(s3.EvictLRU), "which objects are evicted from the disk cache first: lru or lfu")
+	viperBindFlag("diskcache.policy", serveCmd.Flags().Lookup("disk-cache-policy"))
+
+	serveCmd.Flags().Duration("disk-cache-revalidate-after", defaultDiskCacheRevalidateAfter, "how long cached objects are served before their ETag is checked again, 0 to check on every hit")
+	viperBindFlag("diskcache.revalidateafter", serveCmd.Flags().Lookup("disk-cache-revalidate-after"))
+}
+
+// set flags for the in-memory cache of small objects
+func memoryCacheFlags() {
+	serveCmd.Flags().Int64("memory-cache-size", 0, "most bytes of small objects kept in memory, 0 to disable")
+	viperBindFlag("memorycache.maxsize", serveCmd.Flags().Lookup("memory-cache-size"))
+
+	serveCmd.Flags().Int64("memory-cache-max-object-size", defaultMemoryCacheMaxObjectSize, "largest object in bytes kept in memory")
+	viperBindFlag("memorycache.maxobjectsize", serveCmd.Flags().Lookup("memory-cache-max-object-size"))
+
+	serveCmd.Flags().Duration("memory-cache-default-ttl", 0, "how long objects without a max-age are kept in memory, 0 not to keep them")
+	viperBindFlag("memorycache.defaultttl", serveCmd.Flags().Lookup("memory-cache-default-ttl"))
+}
+
+// set flags for coalescing identical GETs
+func coalesceFlags() {
+	serveCmd.Flags().Bool("coalesce-requests", false, "share one read from the stores between identical GETs in flight at once")
+	viperBindFlag("coalesce.enabled", serveCmd.Flags().Lookup("coalesce-requests"))
+
+	serveCmd.Flags().String("coalesce-spool-dir", "", "directory to spool shared bodies in while they are sent")
+	viperBindFlag("coalesce.spooldir", serveCmd.Flags().Lookup("coalesce-spool-dir"))
+}
+
+// set flags for streaming uploads
+func uploadFlags() {
+	serveCmd.Flags().Int64("upload-part-size", s3.MinUploadPartSize, "size in bytes of the parts uploads to S3 are split into, at least 5 MiB")
+	viperBindFlag("upload.partsize", serveCmd.Flags().Lookup("upload-part-size"))
+
+	serveCmd.Flags().Int("upload-concurrency", defaultUploadConcurrency, "how many parts of each upload are sent to S3 at once")
+	viperBindFlag("upload.concurrency", serveCmd.Flags().Lookup("upload-concurrency"))
+
+	serveCmd.Flags().Int64("upload-max-size", 0, "largest upload in bytes accepted, 0 for no limit")
+	viperBindFlag("upload.maxobjectsize", serveCmd.Flags().Lookup("upload-max-size"))
+}
+
+// set flags for redirecting downloads to presigned URLs
+func redirectFlags() {
+	serveCmd.Flags().StringSlice("download-redirect-prefix", nil, "redirect downloads under these prefixes to presigned S3 URLs, every download when only a min size is set")
+	viperBindFlag("redirect.prefixes", serveCmd.Flags().Lookup("download-redirect-prefix"))
+
+	serveCmd.Flags().Int64("download-redirect-min-size", 0, "redirect downloads of objects of at least this many bytes to presigned S3 URLs")
+	viperBindFlag("redirect.minsize", serveCmd.Flags().Lookup("download-redirect-min-size"))
+
+	serveCmd.Flags().Duration("download-redirect-expiry", defaultRedirectExpiry, "how long presigned download URLs are valid for, up to 168h")
+	viperBindFlag("redirect.expiry", serveCmd.Flags().Lookup("download-redirect-expiry"))
+
+	serveCmd.Flags().Int("download-redirect-status", http.StatusFound, "status of download redirects: 302, 303 or 307")
+	viperBindFlag("redirect.status", serveCmd.Flags().Lookup("download-redirect-status"))
+
+	serveCmd.Flags().StringSlice("download-redirect-header", nil, "header S3 answers redirected downloads with instead of the object's, as `name=value`")
+	viperBindFlag("redirect.headers", serveCmd.Flags().Lookup("download-redirect-header"))
+}
+
+// set flags for serving HTTPS
+func tlsFlags() {
+	serveCmd.Flags().String("tls-cert", "", "certificate to serve HTTPS with, reloaded when it changes")
+	viperBindFlag("tls.certfile", serveCmd.Flags().Lookup("tls-cert"))
+
+	serveCmd.Flags().String("tls-key", "", "private key of the TLS certificate")
+	viperBindFlag("tls.keyfile", serveCmd.Flags().Lookup("tls-key"))
+
+	serveCmd.Flags().String("tls-min-version", "1.2", "oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	viperBindFlag("tls.minversion", serveCmd.Flags().Lookup("tls-min-version"))
+
+	serveCmd.Flags().StringSlice("tls-cipher-suites", nil, "cipher suites allowed for TLS 1.2 and older, Go's defaults when unset")
+	viperBindFlag("tls.ciphersuites", serveCmd.Flags().Lookup("tls-cipher-suites"))
+
+	serveCmd.Flags().String("tls-client-ca", "", "CA bundle to verify client certificates against")
+	viperBindFlag("tls.clientcafile", serveCmd.Flags().Lookup("tls-client-ca"))
+
+	serveCmd.Flags().String("tls-client-auth", tlsconfig.ClientAuthRequire, "whether a client certificate is required or optional")
+	viperBindFlag("tls.clientauth", serveCmd.Flags().Lookup("tls-client-auth"))
+
+	serveCmd.Flags().StringSlice("tls-client-rule", nil, "access:field=pattern granting read, write or all to client certificates, e.g. read:CN=ci-*, repeatable")
+	viperBindFlag("tls.clientrules", serveCmd.Flags().Lookup("tls-client-rule"))
 }
 
 func init() {
@@ -210,9 +484,30 @@ func init() {
 	// Set flags for the router
 	httpFlags()
 
+	// Set flags for authentication
+	authFlags()
+
 	// S3 store configs
 	s3Flags()
 
+	// Local disk cache configs
+	diskCacheFlags()
+
+	// In-memory cache configs
+	memoryCacheFlags()
+
+	// Request coalescing configs
+	coalesceFlags()
+
+	// Upload configs
+	uploadFlags()
+
+	// TLS configs
+	tlsFlags()
+
+	// Download redirect configs
+	redirectFlags()
+
 	// Setup the prometheus metrics
 	setupMetrics()
 }
@@ -227,6 +522,85 @@ func setupMetrics() {
 	if err := prometheus.Register(metrics.SecondaryStoreCounter); err != nil {
 		logger.Fatal(err)
 	}
+
+	if err := prometheus.Register(metrics.SecondaryStoreOutcomeCounter); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.BackfillCounter); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.DiskCacheCounter); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.DiskCacheEvictionCounter); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.DiskCacheBytes); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.MemoryCacheCounter); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.MemoryCacheBytes); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.CoalescedCounter); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := prometheus.Register(metrics.RedirectCounter); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+func makeAuth() echo.MiddlewareFunc {
+	c := config.Cfg
+
+	policies, err := auth.NewPolicies(c.Auth.ReadPolicy, c.Auth.WritePolicy)
+	if err != nil {
+		logger.Fatalf("invalid auth policy: %v", err)
+	}
+
+	authenticator, err := auth.New(c.Auth, logger)
+	if err != nil {
+		logger.Fatalf("unable to set up authentication: %v", err)
+	}
+
+	rules, err := auth.ParseCertRules(c.TLS.ClientRules)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if len(rules) > 0 && c.TLS.ClientCAFile == "" {
+		logger.Fatal("client certificate rules require a client CA bundle")
+	}
+
+	// Never expose anything that needs credentials without any to check them
+	// against. Writes only matter once there are write routes.
+	needsUsers := policies.Read == auth.PolicyAuthenticated ||
+		((c.HTTPOpts.EnableUpload || c.Delete.Enabled) && policies.Write == auth.PolicyAuthenticated)
+
+	if needsUsers && len(authenticator) == 0 && len(rules) == 0 {
+		logger.Fatal("an authenticated policy requires auth users, an htpasswd file or client certificate rules")
+	}
+
+	logger.Infof("[config] auth policies: read: %s, write: %s", policies.Read, policies.Write)
+
+	// Health and readiness checks are only on the main listener without an
+	// admin one, otherwise the paths are object keys like any other
+	public := []string{c.HTTPOpts.HealthCheckPath}
+	if c.ServerOpts.AdminListenPort == "" {
+		public = append(public, "/_health", "/_ready")
+	}
+
+	return basicauth.BasicAuth(authenticator, policies, rules, public...)
 }
 
 func makeRouter() (*echo.Echo, *string) {
@@ -242,21 +616,75 @@ func makeRouter() (*echo.Echo, *string) {
 		middleware.RequestID(),
 		middleware.Recover(),
 		middleware.Decompress(),
-		middleware.Gzip(),
+		middleware.GzipWithConfig(middleware.GzipConfig{
+			// HEAD responses have no body to compress, but need their Content-Length
+			Skipper: func(e echo.Context) bool {
+				return e.Request().Method == http.MethodHead
+			},
+		}),
+		makeAuth(),
 	)
 
-	// Metrics middleware
-	metricsMW.Use(router)
+	// Metrics middleware, the metrics themselves being on the admin listener
+	// when there is one
+	if s.AdminListenPort != "" {
+		router.Use(metricsMW.HandlerFunc)
+	} else {
+		metricsMW.Use(router)
+
+		router.GET("/_health", s3.Health())
+		router.GET("/_ready", s3.Ready())
+	}
 
-	router.GET("/_health", s3.Health())
 	router.GET("/*", s3.Handler(s3.AwsS3Get))
-	router.HEAD("/*", s3.Handler(s3.AwsS3Get))
+	router.HEAD("/*", s3.Handler(s3.AwsS3Head))
+
+	if c.HTTPOpts.EnableUpload {
+		// Multipart uploads go by their query rather than by route, so even a
+		// DELETE aborting one gets there without deletes being enabled
+		router.Use(s3.MultipartUploads)
+
+		router.PUT("/*", s3.Handler(s3.AwsS3Put))
+		router.POST("/*", s3.Handler(s3.AwsS3Put))
+	}
+
+	if c.Delete.Enabled {
+		router.DELETE("/*", s3.Handler(s3.AwsS3Delete))
+	}
 
 	addr := net.JoinHostPort(s.ListenAddress, s.ListenPort)
 
 	return router, &addr
 }
 
+// makeAdminRouter sets up the admin listener, which has no authentication
+// and should only be reachable from trusted networks
+func makeAdminRouter() (*echo.Echo, *string) {
+	s := config.Cfg.ServerOpts
+
+	router := echo.New()
+	router.HideBanner = true
+
+	router.Use(middleware.Recover())
+
+	router.GET("/_health", s3.Health())
+	router.GET("/_ready", s3.Ready())
+	router.GET(metricsMW.MetricsPath, echo.WrapHandler(promhttp.Handler()))
+
+	if s.Pprof {
+		router.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+		router.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+		router.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		router.POST("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		router.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+		router.GET("/debug/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	}
+
+	addr := net.JoinHostPort(s.AdminListenAddress, s.AdminListenPort)
+
+	return router, &addr
+}
+
 func serve(ctx context.Context) {
 	// Limits GOMAXPROCS in a container
 	undo, err := maxprocs.Set(maxprocs.Logger(logger.Infof))
@@ -269,34 +697,125 @@ func serve(ctx context.Context) {
 	// This maps the viper values to the Config object
 	config.Load(ctx, logger)
 
+	if _, err := s3.ParseFallbackPolicy(config.Cfg.ReadThrough.FallbackPolicy); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := s3.InitDiskCache(); err != nil {
+		logger.Fatalf("unable to open the disk cache: %v", err)
+	}
+
+	if config.Cfg.HTTPOpts.EnableUpload && config.Cfg.WriteStore() == nil {
+		logger.Fatal("uploads are enabled but no store has the write role")
+	}
+
+	if config.Cfg.Delete.Enabled && config.Cfg.WriteStore() == nil {
+		logger.Fatal("deletes are enabled but no store has the write role")
+	}
+
+	if u := config.Cfg.Upload; u.PartSize < s3.MinUploadPartSize || u.Concurrency < 1 {
+		logger.Fatalf("uploads need parts of at least %d bytes and a concurrency of at least 1", s3.MinUploadPartSize)
+	}
+
+	if config.Cfg.ServerOpts.Pprof && config.Cfg.ServerOpts.AdminListenPort == "" {
+		logger.Fatal("pprof requires an admin listener")
+	}
+
 	router, addr := makeRouter()
 
+	if config.Cfg.Delete.Enabled {
+		s3.StartTrashPurge(ctx)
+	}
+
+	tlsCfg := config.Cfg.TLS
+	if tlsCfg.CertFile != "" {
+		if router.TLSServer.TLSConfig, err = tlsconfig.New(tlsCfg, logger); err != nil {
+			logger.Fatalf("unable to set up TLS: %v", err)
+		}
+
+		router.TLSServer.Addr = *addr
+	} else if tlsCfg.ClientCAFile != "" {
+		logger.Fatal("a client CA bundle requires a TLS certificate")
+	}
+
 	// Set up signal channel for graceful shut down
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
+	var admin *echo.Echo
+
+	if config.Cfg.ServerOpts.AdminListenPort != "" {
+		var adminAddr *string
+
+		admin, adminAddr = makeAdminRouter()
+
+		go func() {
+			logger.Infof("[service] admin listening on %s", *adminAddr)
+
+			if config.Cfg.ServerOpts.Pprof {
+				logger.Info("[config] pprof enabled")
+			}
+
+			if err := admin.Start(*adminAddr); !errors.Is(err, http.ErrServerClosed) {
+				admin.Logger.Fatal(err)
+			}
+		}()
+	}
+
+	s3.SetReady(true)
+
 	// Listen & Serve
 	go func() {
 		logger.Infof("[service] listening on %s", *addr)
 
-		if config.Cfg.PrimaryStore.Session == nil {
-			logger.Error("invalid primary bucket session")
+		for _, store := range config.Cfg.Stores {
+			if store.Type == config.StoreTypeFilesystem {
+				logger.Infof("[config] %s directory: %s, Roles: %v", store.Name, store.Directory, store.Roles)
+			} else {
+				logger.Infof("[config] %s bucket: Name: %s, Roles: %v", store.Name, store.Bucket, store.Roles)
+			}
+
+			logger.Debugf("[config] %s bucket details: %s", store.Name, store)
+		}
+
+		if len(config.Cfg.ReadStores()) > 1 {
+			logger.Infof("[config] read through fall back policy: %s", config.Cfg.ReadThrough.FallbackPolicy)
+		}
+
+		if dc := config.Cfg.DiskCache; dc.Directory != "" {
+			logger.Infof("[config] disk cache: %s, max size: %d, policy: %s", dc.Directory, dc.MaxSize, dc.Policy)
+		}
+
+		if mc := config.Cfg.MemoryCache; mc.MaxSize > 0 {
+			logger.Infof("[config] memory cache: max size: %d, max object size: %d", mc.MaxSize, mc.MaxObjectSize)
+		}
+
+		if config.Cfg.Coalesce.Enabled {
+			logger.Info("[config] coalescing identical requests")
+		}
 
-			shutdown <- os.Interrupt
+		if d := config.Cfg.Delete; d.Enabled {
+			logger.Infof("[config] deletes enabled, trash: %q, retention: %v", d.TrashPrefix, d.TrashRetention)
 		}
 
-		logger.Infof("[config] primary bucket: Name: %s", config.Cfg.PrimaryStore.Bucket)
-		logger.Debugf("[config] primary bucket details: %s", config.Cfg.PrimaryStore)
+		if r := config.Cfg.Redirect; r.Enabled() {
+			logger.Infof("[config] download redirects: prefixes: %v, min size: %d, expiry: %v, status: %d", r.Prefixes, r.MinSize, r.Expiry, r.Status)
+		}
 
-		if config.Cfg.ReadThrough.Enabled {
-			logger.Infof("[config] secondary bucket: Name: %s", config.Cfg.SecondaryStore.Bucket)
-			logger.Debugf("[config] primary bucket details: %s", config.Cfg.SecondaryStore)
+		if u := config.Cfg.Upload; config.Cfg.HTTPOpts.EnableUpload {
+			logger.Infof("[config] uploads enabled, part size: %d, concurrency: %d, max size: %d", u.PartSize, u.Concurrency, u.MaxObjectSize)
+		}
 
-			if config.Cfg.SecondaryStore.Session == nil {
-				logger.Error("invalid secondary bucket session")
+		if tlsCfg.CertFile != "" {
+			logger.Infof("[config] TLS certificate: %s, min version: %s", tlsCfg.CertFile, tlsCfg.MinVersion)
 
-				shutdown <- os.Interrupt
+			if tlsCfg.ClientCAFile != "" {
+				logger.Infof("[config] client certificates: %s, verified against %s", tlsCfg.ClientAuth, tlsCfg.ClientCAFile)
 			}
+
+			router.Logger.Fatal(router.StartServer(router.TLSServer))
+
+			return
 		}
 
 		router.Logger.Fatal(router.Start(*addr))
@@ -304,6 +823,7 @@ func serve(ctx context.Context) {
 
 	<-shutdown
 	logger.Info("Shutting down")
+	s3.SetReady(false)
 
 	// Create a context to allow the server to provide deadline before shutting down
 	ctx, cancel := context.WithTimeout(ctx, time.Duration(exitDelayTimeout)*time.Second)
@@ -315,4 +835,10 @@ func serve(ctx context.Context) {
 	if err := router.Shutdown(ctx); err != nil {
 		logger.Errorf("failed graceful shutdown", err)
 	}
+
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			logger.Errorf("failed graceful shutdown of the admin listener: %v", err)
+		}
+	}
 }
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// UserKey is the echo context key holding who a request was authenticated
+// as, for the access log
+const UserKey = "user"
+
+// ErrInvalidUser is returned when a static user isn't in `user:password` form
+var ErrInvalidUser = errors.New("user must be in the form user:password")
+
+// Authenticator verifies a username and password pair
+type Authenticator interface {
+	Authenticate(username, password string) bool
+}
+
+// Chain tries each Authenticator in order until one accepts the credentials
+type Chain []Authenticator
+
+// Authenticate implements the Authenticator interface for a Chain
+func (c Chain) Authenticate(username, password string) bool {
+	for _, a := range c {
+		if a.Authenticate(username, password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// New builds the Authenticator chain described by the auth config. The chain
+// is empty when no users or htpasswd file are configured.
+func New(a config.Auth, l *zap.SugaredLogger) (Chain, error) {
+	var chain Chain
+
+	// A copy, so the configured users are never appended to
+	users := slices.Clone(a.Users)
+	if a.Username != "" && a.Password != "" {
+		users = append(users, a.Username+":"+a.Password)
+	}
+
+	if len(users) > 0 {
+		static := Static{}
+
+		for _, u := range users {
+			name, secret, ok := strings.Cut(u, ":")
+			if !ok || name == "" || secret == "" {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidUser, name)
+			}
+
+			static[name] = secret
+		}
+
+		chain = append(chain, static)
+	}
+
+	if a.HtpasswdFile != "" {
+		h, err := NewHtpasswd(a.HtpasswdFile, l)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, h)
+	}
+
+	return chain, nil
+}
+
+// Static holds users configured directly, keyed by username. Secrets may be
+// plain text or any hash understood in an htpasswd file.
+type Static map[string]string
+
+// Authenticate implements the Authenticator interface for Static users
+func (s Static) Authenticate(username, password string) bool {
+	secret, ok := s[username]
+	if !ok {
+		return false
+	}
+
+	return verify(secret, password)
+}
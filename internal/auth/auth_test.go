@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestVerify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	secrets := map[string]string{
+		"bcrypt": string(bcryptHash),
+		"sha":    "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"apr1":   "$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0",
+		"plain":  "password",
+	}
+
+	for name, secret := range secrets {
+		assert.True(t, verify(secret, "password"), name)
+		assert.False(t, verify(secret, "wrong"), name)
+	}
+}
+
+func TestNewStaticUsers(t *testing.T) {
+	chain, err := New(config.Auth{
+		Username: "admin",
+		Password: "secret",
+		Users:    []string{"ci:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	assert.True(t, chain.Authenticate("admin", "secret"))
+	assert.True(t, chain.Authenticate("ci", "password"))
+	assert.False(t, chain.Authenticate("ci", "secret"))
+	assert.False(t, chain.Authenticate("nobody", "password"))
+
+	_, err = New(config.Auth{Users: []string{"nopassword"}}, zap.NewNop().Sugar())
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	// the single user isn't added to the configured ones, even where their
+	// slice has room for it
+	backing := make([]string, 2)
+	backing[0] = "ci:secret"
+
+	_, err = New(config.Auth{Username: "admin", Password: "secret", Users: backing[:1]}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	assert.Equal(t, "", backing[1])
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	interval := htpasswdCheckInterval
+	htpasswdCheckInterval = 0
+
+	t.Cleanup(func() { htpasswdCheckInterval = interval })
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+
+	require.NoError(t, os.WriteFile(path, []byte("# users\nalice:$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0\n"), 0o600))
+
+	h, err := NewHtpasswd(path, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	assert.True(t, h.Authenticate("alice", "password"))
+	assert.False(t, h.Authenticate("bob", "password"))
+
+	require.NoError(t, os.WriteFile(path, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+
+	assert.False(t, h.Authenticate("alice", "password"))
+	assert.True(t, h.Authenticate("bob", "password"))
+}
+
+func TestPolicies(t *testing.T) {
+	p, err := NewPolicies("public", "authenticated")
+	require.NoError(t, err)
+
+	assert.Equal(t, PolicyPublic, p.For("GET"))
+	assert.Equal(t, PolicyPublic, p.For("HEAD"))
+	assert.Equal(t, PolicyAuthenticated, p.For("PUT"))
+	assert.Equal(t, PolicyAuthenticated, p.For("DELETE"))
+	assert.Equal(t, PolicyAuthenticated, p.For("OPTIONS"))
+
+	// the parts of an upload are listed with a GET, but only by its writers
+	assert.Equal(t, http.MethodGet, AccessMethod(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/a", RawQuery: "versionId=1"}}))
+	assert.Equal(t, http.MethodPut, AccessMethod(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/a", RawQuery: "uploadId=1"}}))
+
+	_, err = NewPolicies("public", "open")
+	assert.ErrorIs(t, err, ErrUnknownPolicy)
+}
+
+func TestCertRules(t *testing.T) {
+	rules, err := ParseCertRules([]string{"read:O=Example", "all:cn=ci-*", "write:URI=spiffe://prod/*/deploy"})
+	require.NoError(t, err)
+
+	spiffe, err := url.Parse("spiffe://prod/ns/web/deploy")
+	require.NoError(t, err)
+
+	member := &x509.Certificate{Subject: pkix.Name{CommonName: "alice", Organization: []string{"Example"}}}
+	ci := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}}
+	deployer := &x509.Certificate{URIs: []*url.URL{spiffe}}
+
+	assert.True(t, rules.Allow(http.MethodGet, member))
+	assert.False(t, rules.Allow(http.MethodPut, member))
+	assert.True(t, rules.Allow(http.MethodPut, ci))
+	assert.True(t, rules.Allow(http.MethodPut, deployer))
+	assert.False(t, rules.Allow(http.MethodGet, deployer))
+
+	for _, rule := range []string{"read", "read:CN", "read:CN=", "admin:CN=x", "read:SERIAL=1"} {
+		_, err := ParseCertRules([]string{rule})
+		assert.ErrorIs(t, err, ErrInvalidCertRule, rule)
+	}
+}
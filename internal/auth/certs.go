@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidCertRule is returned when a client certificate rule isn't in
+// `access:field=pattern` form
+var ErrInvalidCertRule = errors.New("client certificate rule must be in the form access:field=pattern")
+
+// Accesses a client certificate rule can grant
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessAll   = "all"
+)
+
+// certFields are the certificate identities a rule can match, by name
+var certFields = map[string]func(*x509.Certificate) []string{
+	"CN":    func(c *x509.Certificate) []string { return []string{c.Subject.CommonName} },
+	"O":     func(c *x509.Certificate) []string { return c.Subject.Organization },
+	"OU":    func(c *x509.Certificate) []string { return c.Subject.OrganizationalUnit },
+	"DNS":   func(c *x509.Certificate) []string { return c.DNSNames },
+	"EMAIL": func(c *x509.Certificate) []string { return c.EmailAddresses },
+	"URI": func(c *x509.Certificate) []string {
+		uris := make([]string, 0, len(c.URIs))
+		for _, u := range c.URIs {
+			uris = append(uris, u.String())
+		}
+
+		return uris
+	},
+}
+
+// CertRule grants requests made with a verified client certificate reads,
+// writes or both when one of its identities matches the pattern, in which
+// `*` stands for any run of characters
+type CertRule struct {
+	Access  string
+	Field   string
+	Pattern string
+}
+
+// CertRules are checked in order until one grants access
+type CertRules []CertRule
+
+// ParseCertRules reads rules like `write:CN=ci-*` or `all:URI=spiffe://prod/*`
+func ParseCertRules(rules []string) (CertRules, error) {
+	parsed := make(CertRules, 0, len(rules))
+
+	for _, rule := range rules {
+		access, match, ok := strings.Cut(rule, ":")
+		field, pattern, ok2 := strings.Cut(match, "=")
+		field = strings.ToUpper(field)
+
+		_, known := certFields[field]
+
+		switch {
+		case !ok || !ok2 || pattern == "":
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCertRule, rule)
+		case access != AccessRead && access != AccessWrite && access != AccessAll:
+			return nil, fmt.Errorf("%w: %q has unknown access %q", ErrInvalidCertRule, rule, access)
+		case !known:
+			return nil, fmt.Errorf("%w: %q has unknown field %q", ErrInvalidCertRule, rule, field)
+		}
+
+		parsed = append(parsed, CertRule{Access: access, Field: field, Pattern: pattern})
+	}
+
+	return parsed, nil
+}
+
+// Allow reports whether a rule grants a certificate access to a request of
+// the given method
+func (r CertRules) Allow(method string, cert *x509.Certificate) bool {
+	access := AccessWrite
+	if IsRead(method) {
+		access = AccessRead
+	}
+
+	for _, rule := range r {
+		if rule.Access != access && rule.Access != AccessAll {
+			continue
+		}
+
+		for _, identity := range certFields[rule.Field](cert) {
+			if wildcardMatch(rule.Pattern, identity) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wildcardMatch matches s against a pattern in which `*` stands for any run
+// of characters, slashes included
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+
+	s = s[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+
+		s = s[i+len(part):]
+	}
+
+	last := parts[len(parts)-1]
+
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
@@ -0,0 +1,3 @@
+// Package auth checks basic authentication credentials against static users
+// and htpasswd files, and decides which requests need them
+package auth
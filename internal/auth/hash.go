@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/md5"  //nolint:gosec // apr1 is defined in terms of md5
+	"crypto/sha1" //nolint:gosec // {SHA} is defined in terms of sha1
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	apr1Magic    = "$apr1$"
+	apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	apr1Rounds   = 1000
+	shaPrefix    = "{SHA}"
+)
+
+// verify checks a password against a stored secret, which may be a bcrypt,
+// {SHA} or apr1 hash as written by htpasswd, or otherwise plain text
+func verify(secret, password string) bool {
+	switch {
+	case strings.HasPrefix(secret, "$2a$"), strings.HasPrefix(secret, "$2b$"), strings.HasPrefix(secret, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(secret), []byte(password)) == nil
+	case strings.HasPrefix(secret, shaPrefix):
+		sum := sha1.Sum([]byte(password)) //nolint:gosec
+		return constantTimeEqual(secret, shaPrefix+base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(secret, apr1Magic):
+		salt, _, ok := strings.Cut(strings.TrimPrefix(secret, apr1Magic), "$")
+		if !ok {
+			return false
+		}
+
+		return constantTimeEqual(secret, apr1(password, salt))
+	}
+
+	return constantTimeEqual(secret, password)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// apr1 is Apache's variant of the md5-crypt algorithm
+//
+//nolint:mnd // the magic numbers are part of the algorithm
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	pw := []byte(password)
+	sl := []byte(salt)
+
+	alt := md5.New() //nolint:gosec
+	alt.Write(pw)
+	alt.Write(sl)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New() //nolint:gosec
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write(sl)
+
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(altSum[:min(i, 16)])
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+
+	sum := h.Sum(nil)
+
+	for i := 0; i < apr1Rounds; i++ {
+		r := md5.New() //nolint:gosec
+
+		if i&1 == 1 {
+			r.Write(pw)
+		} else {
+			r.Write(sum)
+		}
+
+		if i%3 != 0 {
+			r.Write(sl)
+		}
+
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+
+		if i&1 == 1 {
+			r.Write(sum)
+		} else {
+			r.Write(pw)
+		}
+
+		sum = r.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for j := 0; j < n; j++ {
+			out = append(out, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+
+	return apr1Magic + salt + "$" + string(out)
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// htpasswdCheckInterval is how often the file is checked for changes
+var htpasswdCheckInterval = time.Second
+
+// Htpasswd authenticates against an Apache htpasswd file, reloading it
+// whenever its size or modification time changes
+type Htpasswd struct {
+	path   string
+	logger *zap.SugaredLogger
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewHtpasswd loads an htpasswd file
+func NewHtpasswd(path string, l *zap.SugaredLogger) (*Htpasswd, error) {
+	h := &Htpasswd{
+		path:   path,
+		logger: l,
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.load(info); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Authenticate implements the Authenticator interface for an htpasswd file
+func (h *Htpasswd) Authenticate(username, password string) bool {
+	h.reloadIfChanged()
+
+	h.mu.RLock()
+	secret, ok := h.users[username]
+	h.mu.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	return verify(secret, password)
+}
+
+func (h *Htpasswd) reloadIfChanged() {
+	h.mu.RLock()
+	fresh := time.Since(h.checked) < htpasswdCheckInterval
+	h.mu.RUnlock()
+
+	if fresh {
+		return
+	}
+
+	h.mu.Lock()
+	h.checked = time.Now()
+	h.mu.Unlock()
+
+	// Stat follows symlinks, so atomically swapped mounts are picked up too
+	info, err := os.Stat(h.path)
+	if err != nil {
+		h.logger.Errorf("unable to stat htpasswd file %s, keeping previous users: %v", h.path, err)
+
+		return
+	}
+
+	h.mu.RLock()
+	changed := !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+	h.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := h.load(info); err != nil {
+		h.logger.Errorf("unable to reload htpasswd file %s, keeping previous users: %v", h.path, err)
+
+		return
+	}
+
+	h.logger.Infof("reloaded htpasswd file %s", h.path)
+}
+
+func (h *Htpasswd) load(info os.FileInfo) error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, secret, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		users[name] = secret
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrUnknownPolicy is returned when a policy name isn't recognised
+var ErrUnknownPolicy = errors.New("unknown auth policy")
+
+// Policy decides what a class of requests needs before it is let through
+type Policy string
+
+const (
+	// PolicyPublic lets every request through
+	PolicyPublic Policy = "public"
+	// PolicyAuthenticated requires valid credentials
+	PolicyAuthenticated Policy = "authenticated"
+	// PolicyDeny refuses every request
+	PolicyDeny Policy = "deny"
+)
+
+// ParsePolicy maps a configured name onto a Policy
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyPublic, PolicyAuthenticated, PolicyDeny:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnknownPolicy, name)
+}
+
+// Policies holds the policy for reads (GET and HEAD) and for writes
+// (PUT, POST, DELETE and any other method)
+type Policies struct {
+	Read  Policy
+	Write Policy
+}
+
+// For returns the policy that applies to an HTTP method
+func (p Policies) For(method string) Policy {
+	if IsRead(method) {
+		return p.Read
+	}
+
+	return p.Write
+}
+
+// IsRead reports whether an HTTP method reads rather than writes. Only GET
+// and HEAD do, any other method being held to the write policy.
+func IsRead(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+
+	return false
+}
+
+// AccessMethod returns the method a request is authorized as: its own,
+// except that listing the parts of a multipart upload is part of writing it
+func AccessMethod(r *http.Request) string {
+	if IsRead(r.Method) && r.URL.Query().Has("uploadId") {
+		return http.MethodPut
+	}
+
+	return r.Method
+}
+
+// NewPolicies parses the configured read and write policy names
+func NewPolicies(read, write string) (Policies, error) {
+	r, err := ParsePolicy(read)
+	if err != nil {
+		return Policies{}, err
+	}
+
+	w, err := ParsePolicy(write)
+	if err != nil {
+		return Policies{}, err
+	}
+
+	return Policies{Read: r, Write: w}, nil
+}
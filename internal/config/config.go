@@ -8,9 +8,9 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
@@ -22,16 +22,124 @@ var Cfg *Config
 type ReadThrough struct {
 	Enabled        bool
 	CacheToPrimary bool
+
+	// MaxCacheSize is the largest object in bytes copied to the primary
+	// store, 0 means no limit
+	MaxCacheSize int64
+	// BackfillMemory is how many bytes of downloads are held in memory until
+	// they are copied to the primary store, past which they are spooled to
+	// SpoolDir, the system temp dir by default
+	BackfillMemory int64
+	SpoolDir       string
+	// BackfillWorkers is how many objects are copied to the primary store at
+	// once, and BackfillQueueSize how many more may wait for a worker
+	BackfillWorkers   int
+	BackfillQueueSize int
+	// BackfillTimeout is how long a copy to the primary store may take once
+	// the client has read the object, 0 meaning no limit
+	BackfillTimeout time.Duration
+
+	// FallbackPolicy is which primary errors are read through: not-found,
+	// not-found-and-5xx or all
+	FallbackPolicy string
+	// NegativeCacheTTL is how long keys missing from both stores are
+	// remembered, 0 disables it
+	NegativeCacheTTL time.Duration
+	// NegativeCacheSize is how many missing keys are remembered at most
+	NegativeCacheSize int
+}
+
+// DiskCache is a local cache of whole objects in front of the stores
+type DiskCache struct {
+	// Directory holds the cached objects, the cache is off when unset
+	Directory string
+	// MaxSize is how many bytes of objects are kept at most
+	MaxSize int64
+	// Policy is which objects are evicted first: lru or lfu
+	Policy string
+	// RevalidateAfter is how long a cached object is served before its ETag
+	// is checked against the stores again, 0 to check on every hit
+	RevalidateAfter time.Duration
+}
+
+// MemoryCache is an in-process cache of small objects
+type MemoryCache struct {
+	// MaxSize is how many bytes of objects are kept at most, the cache is
+	// off when 0
+	MaxSize int64
+	// MaxObjectSize is the largest object kept
+	MaxObjectSize int64
+	// DefaultTTL is how long objects sent without a max-age are kept, 0 not
+	// to keep them
+	DefaultTTL time.Duration
+}
+
+// Coalesce shares one read from the stores between identical GETs in
+// flight at the same time
+type Coalesce struct {
+	Enabled bool
+	// SpoolDir holds shared bodies while they are sent, defaults to the
+	// system temp dir
+	SpoolDir string
+}
+
+// Upload is how uploads are streamed to the write store
+type Upload struct {
+	// PartSize is the size of the parts uploads to S3 are split into
+	PartSize int64
+	// Concurrency is how many parts of an upload are sent at once
+	Concurrency int
+	// MaxObjectSize is the largest upload accepted, 0 for no limit
+	MaxObjectSize int64
+}
+
+// Delete is how objects are deleted from the write store
+type Delete struct {
+	Enabled bool
+	// TrashPrefix turns deletes into moves under it, deletes being final
+	// when unset
+	TrashPrefix string
+	// TrashRetention is how long objects are kept in the trash, 0 to keep
+	// them until they are removed by other means
+	TrashRetention time.Duration
+}
+
+// TLS has the certificate the proxy serves HTTPS with, which is off when
+// unset, and how client certificates are verified
+type TLS struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is the oldest TLS version accepted: 1.0 to 1.3
+	MinVersion string
+	// CipherSuites limit the suites of TLS 1.2 and older, by name
+	CipherSuites []string
+
+	// ClientCAFile is the CA bundle client certificates are verified
+	// against, which they aren't when unset
+	ClientCAFile string
+	// ClientAuth is whether a client certificate is required or optional
+	ClientAuth string
+	// ClientRules grant access to client certificates by identity
+	ClientRules []string
 }
 
 // String implements the Stringer interface for the Bucket struct
 func (b Bucket) String() string {
-	return fmt.Sprintf("Name: %s, AccessKey: %s, SecretKey: %s, Endpoint: %s, IdleConnTimeout: %v, Region: %s, S3Prefix: %s, InsecureTLS: %v, DisableCompression: %v, DisableBucketSSL: %v, MaxIdleConns: %d",
-		b.Bucket, b.AccessKey, "********", b.Endpoint, b.IdleConnTimeout, b.Region, b.S3Prefix, b.InsecureTLS, b.DisableCompression, b.DisableBucketSSL, b.MaxIdleConns)
+	return fmt.Sprintf("Store: %s, Roles: %v, Type: %s, Directory: %s, Name: %s, Credentials: %s, AccessKey: %s, SecretKey: %s, Profile: %s, RoleARN: %s, Endpoint: %s, IdleConnTimeout: %v, Region: %s, S3Prefix: %s, InsecureTLS: %v, DisableCompression: %v, DisableBucketSSL: %v, MaxIdleConns: %d, ACL: %s, StorageClass: %s, SSE: %s, PrefixUploads: %d",
+		b.Name, b.Roles, b.Type, b.Directory, b.Bucket, b.credentialsMode(), b.AccessKey, "********", b.Profile, b.RoleARN, b.Endpoint, b.IdleConnTimeout, b.Region, b.S3Prefix, b.InsecureTLS, b.DisableCompression, b.DisableBucketSSL, b.MaxIdleConns, b.ACL, b.StorageClass, b.SSE, len(b.PrefixUploads))
 }
 
 // Bucket has the attributes needed to interact with S3 buckets
 type Bucket struct {
+	// Name identifies the store in logs and metrics
+	Name string
+	// Roles are what the store is used for: read, write and cache
+	Roles []string
+	// Type is where objects are kept: s3 or filesystem
+	Type string
+	// Directory is the root of a filesystem store
+	Directory string
+
 	AccessKey       string
 	Endpoint        string
 	IdleConnTimeout time.Duration
@@ -40,13 +148,30 @@ type Bucket struct {
 	S3Prefix        string
 	SecretKey       string
 
-	Session *session.Session
+	// Credentials is how requests are signed: static, default, profile,
+	// assume-role or web-identity. When unset, the keys are used if given,
+	// otherwise the default chain.
+	Credentials          string
+	Profile              string
+	RoleARN              string
+	ExternalID           string
+	RoleSessionName      string
+	RoleDuration         time.Duration
+	WebIdentityTokenFile string
+
+	// AWSConfig is what the bucket's client is built from
+	AWSConfig aws.Config
 
 	InsecureTLS        bool
 	DisableCompression bool
 	DisableBucketSSL   bool
 
 	MaxIdleConns int
+
+	// UploadSettings apply to objects written to the store, unless
+	// overridden for the longest of the PrefixUploads matching their key
+	UploadSettings `mapstructure:",squash"`
+	PrefixUploads  []PrefixUpload
 }
 
 // HTTPOpts has http options
@@ -55,25 +180,59 @@ type HTTPOpts struct {
 	HealthCheckPath  string
 	HTTPCacheControl string
 	HTTPExpires      string
+	NotFoundDocument string
+
+	IndexDocuments []string
 
 	ContentEncoding bool
 	EnableUpload    bool
+	Listing         bool
+	RedirectToIndex bool
+}
+
+// Auth has the credentials and policies for authenticating requests
+type Auth struct {
+	Username     string
+	Password     string
+	Users        []string
+	HtpasswdFile string
+	ReadPolicy   string
+	WritePolicy  string
 }
 
 // ServerOpts has configs for how to bind
 type ServerOpts struct {
 	ListenAddress string
 	ListenPort    string
+
+	// AdminListenPort moves health, readiness and metrics off the main
+	// listener onto their own, which is off when unset
+	AdminListenAddress string
+	AdminListenPort    string
+	// Pprof serves the runtime profiles on the admin listener
+	Pprof bool
 }
 
 // Config encapsulates other config options
 type Config struct {
+	Auth           Auth
 	HTTPOpts       HTTPOpts
 	ServerOpts     ServerOpts
 	Logger         *zap.SugaredLogger
 	SecondaryStore Bucket
 	PrimaryStore   Bucket
 	ReadThrough    ReadThrough
+	DiskCache      DiskCache
+	MemoryCache    MemoryCache
+	Coalesce       Coalesce
+	TLS            TLS
+	Upload         Upload
+	Delete         Delete
+	Redirect       Redirect
+
+	// Stores are tried in order, when unset they are made up of the
+	// primary and secondary stores
+	Stores []Bucket
 }
 
 // Load configurations and map to the config struct
@@ -84,44 +243,80 @@ func Load(ctx context.Context, l *zap.SugaredLogger) {
 
 	Cfg.Logger = l
 
-	Cfg.PrimaryStore.BuildS3API()
-	Cfg.SecondaryStore.BuildS3API()
+	if len(Cfg.Stores) == 0 {
+		Cfg.Stores = Cfg.legacyStores()
+	}
+
+	if err := Cfg.validateStores(); err != nil {
+		log.Fatalf("Invalid stores, %v", err)
+	}
+
+	if err := Cfg.Redirect.validate(); err != nil {
+		log.Fatalf("Invalid download redirects, %v", err)
+	}
+
+	for i := range Cfg.Stores {
+		if Cfg.Stores[i].Type != StoreTypeS3 {
+			continue
+		}
+
+		if err := Cfg.Stores[i].BuildS3API(ctx); err != nil {
+			log.Fatalf("Unable to set up store %s, %v", Cfg.Stores[i].Name, err)
+		}
+	}
 
 	Cfg.Logger.Info("configuration loaded")
 }
 
-// BuildS3API creates a client per bucket
-func (b *Bucket) BuildS3API() {
-	b.Session = session.Must(session.NewSession(b.buildAwsConfig()))
-}
-
-func (b *Bucket) buildAwsConfig() *aws.Config {
-	awsCfg := &aws.Config{
-		Region:      &b.Region,
-		Credentials: credentials.NewStaticCredentials(b.AccessKey, b.SecretKey, ""),
-		DisableSSL:  aws.Bool(b.DisableBucketSSL),
-		HTTPClient: &http.Client{
-			Transport: &http.Transport{
-				Proxy:              http.ProxyFromEnvironment,
-				MaxIdleConns:       b.MaxIdleConns,
-				IdleConnTimeout:    b.IdleConnTimeout,
-				DisableCompression: b.DisableCompression,
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: b.InsecureTLS,
-				},
-			},
-		},
+// BuildS3API resolves the SDK configuration the bucket's client is built
+// from, including its credentials
+func (b *Bucket) BuildS3API(ctx context.Context) error {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithHTTPClient(b.httpClient()),
+	}
+
+	if b.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(b.Region))
+	}
+
+	if b.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(b.Profile))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return err
 	}
 
 	// if unset, not using AWS s3 so meh
-	if b.Region == "" {
-		b.Region = "meh"
+	if cfg.Region == "" {
+		cfg.Region = "meh"
+	}
+
+	creds, err := b.buildCredentials(cfg)
+	if err != nil {
+		return err
 	}
 
-	if b.Endpoint != "" {
-		awsCfg.Endpoint = &b.Endpoint
-		awsCfg.S3ForcePathStyle = aws.Bool(true)
+	if creds != nil {
+		cfg.Credentials = creds
 	}
 
-	return awsCfg
+	b.AWSConfig = cfg
+
+	return nil
+}
+
+func (b *Bucket) httpClient() *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+		t.MaxIdleConns = b.MaxIdleConns
+		t.IdleConnTimeout = b.IdleConnTimeout
+		t.DisableCompression = b.DisableCompression
+
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+
+		t.TLSClientConfig.InsecureSkipVerify = b.InsecureTLS
+	})
 }
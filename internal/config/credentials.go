@@ -0,0 +1,137 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Credential modes of a store
+const (
+	// CredentialsStatic signs with the store's access and secret keys
+	CredentialsStatic = "static"
+	// CredentialsDefault uses the SDK's default chain: environment, shared
+	// files, web identity, then container or EC2 instance roles
+	CredentialsDefault = "default"
+	// CredentialsProfile uses a named profile from the shared files
+	CredentialsProfile = "profile"
+	// CredentialsAssumeRole assumes a role using the store's keys, or its
+	// profile, or the default chain
+	CredentialsAssumeRole = "assume-role"
+	// CredentialsWebIdentity exchanges a web identity token, as mounted by
+	// IRSA on EKS, for role credentials
+	CredentialsWebIdentity = "web-identity"
+)
+
+// credentialsExpiryWindow is how long before they expire temporary
+// credentials are refreshed
+const credentialsExpiryWindow = time.Minute
+
+var (
+	// ErrUnknownCredentials is returned when a credential mode isn't recognised
+	ErrUnknownCredentials = errors.New("unknown credentials mode")
+	// ErrMissingCredentials is returned when a credential mode lacks a setting
+	ErrMissingCredentials = errors.New("missing credentials setting")
+)
+
+// credentialsMode is the configured mode, defaulting to static keys when
+// they are set and the default chain otherwise
+func (b *Bucket) credentialsMode() string {
+	switch {
+	case b.Credentials != "":
+		return b.Credentials
+	case b.AccessKey != "" || b.SecretKey != "":
+		return CredentialsStatic
+	}
+
+	return CredentialsDefault
+}
+
+// buildCredentials returns the credentials to sign the store's requests
+// with, nil meaning those resolved by the SDK's default chain or profile.
+// Temporary credentials are cached and refreshed shortly before they expire.
+func (b *Bucket) buildCredentials(cfg aws.Config) (aws.CredentialsProvider, error) {
+	var provider aws.CredentialsProvider
+
+	switch mode := b.credentialsMode(); mode {
+	case CredentialsStatic:
+		if b.AccessKey == "" || b.SecretKey == "" {
+			return nil, fmt.Errorf("%w: %s needs an access and secret key", ErrMissingCredentials, b.Name)
+		}
+
+		provider = credentials.NewStaticCredentialsProvider(b.AccessKey, b.SecretKey, "")
+	case CredentialsDefault:
+		return nil, nil
+	case CredentialsProfile:
+		if b.Profile == "" {
+			return nil, fmt.Errorf("%w: %s needs a profile", ErrMissingCredentials, b.Name)
+		}
+
+		return nil, nil
+	case CredentialsAssumeRole:
+		if b.RoleARN == "" {
+			return nil, fmt.Errorf("%w: %s needs a role ARN", ErrMissingCredentials, b.Name)
+		}
+
+		provider = stscreds.NewAssumeRoleProvider(b.stsClient(cfg), b.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = b.RoleSessionName
+
+			if b.ExternalID != "" {
+				o.ExternalID = aws.String(b.ExternalID)
+			}
+
+			if b.RoleDuration > 0 {
+				o.Duration = b.RoleDuration
+			}
+		})
+	case CredentialsWebIdentity:
+		roleARN := firstNonEmpty(b.RoleARN, os.Getenv("AWS_ROLE_ARN"))
+		tokenFile := firstNonEmpty(b.WebIdentityTokenFile, os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+
+		if roleARN == "" || tokenFile == "" {
+			return nil, fmt.Errorf("%w: %s needs a role ARN and web identity token file", ErrMissingCredentials, b.Name)
+		}
+
+		provider = stscreds.NewWebIdentityRoleProvider(b.stsClient(cfg), roleARN, stscreds.IdentityTokenFile(tokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = b.RoleSessionName
+
+				if b.RoleDuration > 0 {
+					o.Duration = b.RoleDuration
+				}
+			})
+	default:
+		return nil, fmt.Errorf("%w: %s has %q", ErrUnknownCredentials, b.Name, mode)
+	}
+
+	return aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = credentialsExpiryWindow
+	}), nil
+}
+
+// stsClient is what roles are assumed with. It talks to STS rather than the
+// store's endpoint, signing with the store's keys if set, otherwise those of
+// its profile or the default chain.
+func (b *Bucket) stsClient(cfg aws.Config) *sts.Client {
+	if b.AccessKey != "" {
+		cfg.Credentials = credentials.NewStaticCredentialsProvider(b.AccessKey, b.SecretKey, "")
+	}
+
+	return sts.NewFromConfig(cfg)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsMode(t *testing.T) {
+	assert.Equal(t, CredentialsDefault, (&Bucket{}).credentialsMode())
+	assert.Equal(t, CredentialsStatic, (&Bucket{AccessKey: "a", SecretKey: "b"}).credentialsMode())
+	assert.Equal(t, CredentialsProfile, (&Bucket{AccessKey: "a", Credentials: CredentialsProfile}).credentialsMode())
+}
+
+func TestBuildCredentials(t *testing.T) {
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+
+	b := &Bucket{AccessKey: "a", SecretKey: "b"}
+	creds, err := b.buildCredentials(aws.Config{})
+	require.NoError(t, err)
+
+	v, err := creds.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "a", v.AccessKeyID)
+
+	b = &Bucket{Credentials: CredentialsAssumeRole, RoleARN: "arn:aws:iam::123456789012:role/proxy", ExternalID: "x"}
+	creds, err = b.buildCredentials(aws.Config{})
+	require.NoError(t, err)
+	assert.NotNil(t, creds)
+
+	for _, b := range []*Bucket{
+		{Credentials: CredentialsStatic, AccessKey: "a"},
+		{Credentials: CredentialsProfile},
+		{Credentials: CredentialsAssumeRole},
+		{Credentials: CredentialsWebIdentity, RoleARN: "arn:aws:iam::123456789012:role/proxy"},
+	} {
+		_, err := b.buildCredentials(aws.Config{})
+		assert.ErrorIs(t, err, ErrMissingCredentials, b.Credentials)
+	}
+
+	b = &Bucket{Credentials: "ldap"}
+	_, err = b.buildCredentials(aws.Config{})
+	assert.ErrorIs(t, err, ErrUnknownCredentials)
+}
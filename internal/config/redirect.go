@@ -0,0 +1,109 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrRedirectStatus is returned when downloads are redirected with a
+	// status that isn't a redirect keeping the GET
+	ErrRedirectStatus = errors.New("redirect status must be 302, 303 or 307")
+	// ErrRedirectExpiry is returned when presigned URLs would not be valid,
+	// S3 taking them for a week at most
+	ErrRedirectExpiry = errors.New("redirect expiry must be positive and at most 168h")
+	// ErrRedirectHeader is returned when a response header override isn't
+	// one S3 can send
+	ErrRedirectHeader = errors.New("unknown response header override")
+)
+
+// maxPresignExpiry is the longest a presigned URL is valid for
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// redirectHeaders are the headers of the object S3 can be told to answer a
+// presigned GET with instead of its own
+var redirectHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Content-Type", "Expires"}
+
+// Redirect sends downloads straight to the store with a presigned URL
+// rather than through the proxy. It applies to objects under one of the
+// prefixes, or anywhere when there are none, of at least MinSize bytes, and
+// is off when neither is set.
+type Redirect struct {
+	Prefixes []string
+	MinSize  int64
+	// Expiry is how long the presigned URLs are valid for
+	Expiry time.Duration
+	// Status is the redirect status, 302 or 307 usually
+	Status int
+	// Headers override the headers the store answers with, as name=value
+	Headers []string
+}
+
+// Enabled reports whether any download is redirected
+func (r *Redirect) Enabled() bool {
+	return len(r.Prefixes) > 0 || r.MinSize > 0
+}
+
+// Matches reports whether downloads of a key are redirected when large
+// enough
+func (r *Redirect) Matches(key string) bool {
+	if !r.Enabled() {
+		return false
+	}
+
+	if len(r.Prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range r.Prefixes {
+		if strings.HasPrefix(key, strings.TrimPrefix(p, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResponseHeaders returns the header overrides by their canonical name
+func (r *Redirect) ResponseHeaders() map[string]string {
+	headers := map[string]string{}
+
+	for _, h := range r.Headers {
+		name, value, _ := strings.Cut(h, "=")
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+
+	return headers
+}
+
+func (r *Redirect) validate() error {
+	if !r.Enabled() {
+		return nil
+	}
+
+	switch r.Status {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		return fmt.Errorf("%w: %d", ErrRedirectStatus, r.Status)
+	}
+
+	if r.Expiry <= 0 || r.Expiry > maxPresignExpiry {
+		return ErrRedirectExpiry
+	}
+
+	for name, value := range r.ResponseHeaders() {
+		if !slices.Contains(redirectHeaders, name) {
+			return fmt.Errorf("%w: %q", ErrRedirectHeader, name)
+		}
+
+		if _, err := http.ParseTime(value); name == "Expires" && err != nil {
+			return fmt.Errorf("%w: Expires needs an HTTP date: %w", ErrRedirectHeader, err)
+		}
+	}
+
+	return nil
+}
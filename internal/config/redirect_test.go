@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirect(t *testing.T) {
+	r := &Redirect{Status: 302, Expiry: time.Minute}
+	assert.False(t, r.Matches("images/a.raw"))
+	assert.NoError(t, r.validate())
+
+	r.MinSize = 1 << 30
+	assert.True(t, r.Matches("images/a.raw"))
+
+	r.Prefixes = []string{"/images/"}
+	r.Headers = []string{"content-disposition = attachment"}
+	assert.True(t, r.Matches("images/a.raw"))
+	assert.False(t, r.Matches("docs/a.txt"))
+	assert.Equal(t, map[string]string{"Content-Disposition": "attachment"}, r.ResponseHeaders())
+	assert.NoError(t, r.validate())
+
+	for err, bad := range map[error]Redirect{
+		ErrRedirectStatus: {Status: 301, Expiry: time.Minute},
+		ErrRedirectExpiry: {Status: 307, Expiry: 8 * 24 * time.Hour},
+		ErrRedirectHeader: {Status: 307, Expiry: time.Minute, Headers: []string{"Location=/"}},
+	} {
+		bad.MinSize = 1
+		assert.ErrorIs(t, bad.validate(), err)
+	}
+}
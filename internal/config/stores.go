@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Store roles
+const (
+	// RoleRead stores are tried in order for downloads and listings
+	RoleRead = "read"
+	// RoleWrite is the store uploads go to, the first one if there are several
+	RoleWrite = "write"
+	// RoleCache stores get a copy of objects read from a later store
+	RoleCache = "cache"
+)
+
+// Store types
+const (
+	// StoreTypeS3 keeps objects in an S3 bucket, the default
+	StoreTypeS3 = "s3"
+	// StoreTypeFilesystem keeps objects as files under a local directory
+	StoreTypeFilesystem = "filesystem"
+)
+
+var (
+	// ErrNoReadStore is returned when no store can be read from
+	ErrNoReadStore = errors.New("at least one store needs the read role")
+	// ErrUnknownRole is returned when a store has a role that isn't recognised
+	ErrUnknownRole = errors.New("unknown store role")
+	// ErrDuplicateStore is returned when two stores have the same name
+	ErrDuplicateStore = errors.New("duplicate store name")
+	// ErrUnknownStoreType is returned when a store type isn't recognised
+	ErrUnknownStoreType = errors.New("unknown store type")
+	// ErrMissingDirectory is returned when a filesystem store has no directory
+	ErrMissingDirectory = errors.New("filesystem store needs a directory")
+)
+
+// Has reports whether a store has a role
+func (b *Bucket) Has(role string) bool {
+	return slices.Contains(b.Roles, role)
+}
+
+// ReadStores returns the stores to read from, in the order to try them
+func (c *Config) ReadStores() []*Bucket {
+	return c.storesWith(RoleRead)
+}
+
+// CacheStores returns the stores that keep copies of objects read from
+// later stores
+func (c *Config) CacheStores() []*Bucket {
+	return c.storesWith(RoleCache)
+}
+
+// WriteStore returns the store uploads go to, or nil if there isn't one
+func (c *Config) WriteStore() *Bucket {
+	if stores := c.storesWith(RoleWrite); len(stores) > 0 {
+		return stores[0]
+	}
+
+	return nil
+}
+
+func (c *Config) storesWith(role string) []*Bucket {
+	var stores []*Bucket
+
+	for i := range c.Stores {
+		if c.Stores[i].Has(role) {
+			stores = append(stores, &c.Stores[i])
+		}
+	}
+
+	return stores
+}
+
+// legacyStores makes up the store list from the primary and secondary stores.
+// The secondary store is only read from when reading through, and the primary
+// store caches what is read from it when asked to.
+func (c *Config) legacyStores() []Bucket {
+	primary := c.PrimaryStore
+	primary.Name = "primary"
+	primary.Roles = []string{RoleRead, RoleWrite}
+
+	if c.ReadThrough.CacheToPrimary {
+		primary.Roles = append(primary.Roles, RoleCache)
+	}
+
+	stores := []Bucket{primary}
+
+	if c.ReadThrough.Enabled {
+		secondary := c.SecondaryStore
+		secondary.Name = "secondary"
+		secondary.Roles = []string{RoleRead}
+
+		stores = append(stores, secondary)
+	}
+
+	return stores
+}
+
+func (c *Config) validateStores() error {
+	names := map[string]bool{}
+
+	for i := range c.Stores {
+		b := &c.Stores[i]
+
+		if b.Name == "" {
+			b.Name = fmt.Sprintf("store-%d", i)
+		}
+
+		if names[b.Name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateStore, b.Name)
+		}
+
+		names[b.Name] = true
+
+		switch b.Type {
+		case "":
+			b.Type = StoreTypeS3
+		case StoreTypeS3:
+		case StoreTypeFilesystem:
+			if b.Directory == "" {
+				return fmt.Errorf("%w: %s", ErrMissingDirectory, b.Name)
+			}
+		default:
+			return fmt.Errorf("%w: %s has %q", ErrUnknownStoreType, b.Name, b.Type)
+		}
+
+		for _, role := range b.Roles {
+			switch role {
+			case RoleRead, RoleWrite, RoleCache:
+			default:
+				return fmt.Errorf("%w: %s has %q", ErrUnknownRole, b.Name, role)
+			}
+		}
+
+		if err := b.validateUploads(); err != nil {
+			return err
+		}
+	}
+
+	if len(c.ReadStores()) == 0 {
+		return ErrNoReadStore
+	}
+
+	return nil
+}
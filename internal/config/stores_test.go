@@ -0,0 +1,47 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacyStores(t *testing.T) {
+	c := &Config{
+		PrimaryStore:   Bucket{Bucket: "primary"},
+		SecondaryStore: Bucket{Bucket: "secondary"},
+		ReadThrough:    ReadThrough{Enabled: true, CacheToPrimary: true},
+	}
+
+	c.Stores = c.legacyStores()
+	require.NoError(t, c.validateStores())
+
+	require.Len(t, c.ReadStores(), 2)
+	assert.Equal(t, "primary", c.ReadStores()[0].Name)
+	assert.Equal(t, "secondary", c.ReadStores()[1].Bucket)
+	assert.Equal(t, "primary", c.WriteStore().Bucket)
+	assert.Len(t, c.CacheStores(), 1)
+}
+
+func TestValidateStores(t *testing.T) {
+	c := &Config{Stores: []Bucket{{Roles: []string{RoleRead}}, {Roles: []string{RoleCache}}}}
+	require.NoError(t, c.validateStores())
+	assert.Equal(t, "store-1", c.Stores[1].Name)
+	assert.Nil(t, c.WriteStore())
+
+	c = &Config{Stores: []Bucket{{Name: "a", Roles: []string{RoleRead}}, {Name: "a"}}}
+	assert.ErrorIs(t, c.validateStores(), ErrDuplicateStore)
+
+	c = &Config{Stores: []Bucket{{Roles: []string{"mirror"}}}}
+	assert.ErrorIs(t, c.validateStores(), ErrUnknownRole)
+
+	c = &Config{Stores: []Bucket{{Roles: []string{RoleWrite}}}}
+	assert.ErrorIs(t, c.validateStores(), ErrNoReadStore)
+
+	c = &Config{Stores: []Bucket{{Roles: []string{RoleRead}, Type: StoreTypeFilesystem}}}
+	assert.ErrorIs(t, c.validateStores(), ErrMissingDirectory)
+
+	c = &Config{Stores: []Bucket{{Roles: []string{RoleRead}, Type: "tape"}}}
+	assert.ErrorIs(t, c.validateStores(), ErrUnknownStoreType)
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Upload ACLs besides the canned ones
+const (
+	// ACLNone sends no ACL, for buckets with ACLs disabled
+	ACLNone = "none"
+	// DefaultACL is the ACL of uploads when a store doesn't set one
+	DefaultACL = string(types.ObjectCannedACLPublicRead)
+)
+
+var (
+	// ErrUnknownACL is returned when an upload ACL isn't a canned ACL
+	ErrUnknownACL = errors.New("unknown canned ACL")
+	// ErrUnknownStorageClass is returned when a storage class isn't recognised
+	ErrUnknownStorageClass = errors.New("unknown storage class")
+	// ErrUnknownSSE is returned when a server side encryption isn't recognised
+	ErrUnknownSSE = errors.New("unknown server side encryption")
+	// ErrKMSKeyWithoutKMS is returned when a KMS key is given for encryption
+	// that doesn't use KMS
+	ErrKMSKeyWithoutKMS = errors.New("a KMS key ID needs aws:kms encryption")
+)
+
+// UploadSettings are how objects are written to a store
+type UploadSettings struct {
+	// ACL is the canned ACL of new objects, public-read when unset and none
+	// for buckets with ACLs disabled
+	ACL string
+	// StorageClass is the storage class of new objects, the bucket's default
+	// when unset
+	StorageClass string
+	// SSE encrypts new objects at rest: AES256 or aws:kms, which is implied
+	// by a KMS key ID
+	SSE         string
+	SSEKMSKeyID string
+}
+
+// PrefixUpload overrides the upload settings of a store for keys under a
+// prefix, settings it leaves unset being the store's
+type PrefixUpload struct {
+	Prefix         string
+	UploadSettings `mapstructure:",squash"`
+}
+
+// UploadSettingsFor returns the settings an object is written to the store
+// with, from the longest prefix matching its key if any. The ACL is left
+// empty when none is to be sent.
+func (b *Bucket) UploadSettingsFor(key string) UploadSettings {
+	u := b.UploadSettings
+
+	var match *PrefixUpload
+
+	for i := range b.PrefixUploads {
+		p := &b.PrefixUploads[i]
+		if strings.HasPrefix(key, strings.TrimPrefix(p.Prefix, "/")) && (match == nil || len(p.Prefix) > len(match.Prefix)) {
+			match = p
+		}
+	}
+
+	if match != nil {
+		if match.ACL != "" {
+			u.ACL = match.ACL
+		}
+
+		if match.StorageClass != "" {
+			u.StorageClass = match.StorageClass
+		}
+
+		// Encryption is overridden as a whole, so a prefix can't end up with
+		// the store's KMS key and its own algorithm
+		if match.SSE != "" || match.SSEKMSKeyID != "" {
+			u.SSE, u.SSEKMSKeyID = match.SSE, match.SSEKMSKeyID
+		}
+	}
+
+	switch u.ACL {
+	case "":
+		u.ACL = DefaultACL
+	case ACLNone:
+		u.ACL = ""
+	}
+
+	if u.SSE == "" && u.SSEKMSKeyID != "" {
+		u.SSE = string(types.ServerSideEncryptionAwsKms)
+	}
+
+	return u
+}
+
+func (u *UploadSettings) validate() error {
+	if u.ACL != "" && u.ACL != ACLNone && !slices.Contains(types.ObjectCannedACL("").Values(), types.ObjectCannedACL(u.ACL)) {
+		return fmt.Errorf("%w: %q", ErrUnknownACL, u.ACL)
+	}
+
+	if u.StorageClass != "" && !slices.Contains(types.StorageClass("").Values(), types.StorageClass(u.StorageClass)) {
+		return fmt.Errorf("%w: %q", ErrUnknownStorageClass, u.StorageClass)
+	}
+
+	if u.SSE != "" && !slices.Contains(types.ServerSideEncryption("").Values(), types.ServerSideEncryption(u.SSE)) {
+		return fmt.Errorf("%w: %q", ErrUnknownSSE, u.SSE)
+	}
+
+	if u.SSEKMSKeyID != "" && u.SSE == string(types.ServerSideEncryptionAes256) {
+		return ErrKMSKeyWithoutKMS
+	}
+
+	return nil
+}
+
+func (b *Bucket) validateUploads() error {
+	if err := b.UploadSettings.validate(); err != nil {
+		return fmt.Errorf("%s: %w", b.Name, err)
+	}
+
+	for i := range b.PrefixUploads {
+		if err := b.PrefixUploads[i].validate(); err != nil {
+			return fmt.Errorf("%s under %s: %w", b.Name, b.PrefixUploads[i].Prefix, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadSettingsFor(t *testing.T) {
+	b := &Bucket{
+		UploadSettings: UploadSettings{StorageClass: "STANDARD_IA", SSEKMSKeyID: "alias/store"},
+		PrefixUploads: []PrefixUpload{
+			{Prefix: "/private/", UploadSettings: UploadSettings{ACL: ACLNone}},
+			{Prefix: "/private/archive/", UploadSettings: UploadSettings{StorageClass: "GLACIER", SSE: "AES256"}},
+		},
+	}
+
+	assert.Equal(t, UploadSettings{ACL: DefaultACL, StorageClass: "STANDARD_IA", SSE: "aws:kms", SSEKMSKeyID: "alias/store"}, b.UploadSettingsFor("public/a.txt"))
+	assert.Equal(t, UploadSettings{StorageClass: "STANDARD_IA", SSE: "aws:kms", SSEKMSKeyID: "alias/store"}, b.UploadSettingsFor("private/a.txt"))
+
+	// only the longest prefix applies, and encryption is replaced as a whole
+	assert.Equal(t, UploadSettings{ACL: DefaultACL, StorageClass: "GLACIER", SSE: "AES256"}, b.UploadSettingsFor("private/archive/a.txt"))
+
+	assert.NoError(t, b.validateUploads())
+
+	for err, u := range map[error]UploadSettings{
+		ErrUnknownACL:          {ACL: "public"},
+		ErrUnknownStorageClass: {StorageClass: "COLD"},
+		ErrUnknownSSE:          {SSE: "rot13"},
+		ErrKMSKeyWithoutKMS:    {SSE: "AES256", SSEKMSKeyID: "alias/store"},
+	} {
+		b := &Bucket{PrefixUploads: []PrefixUpload{{Prefix: "x/", UploadSettings: u}}}
+		assert.ErrorIs(t, b.validateUploads(), err)
+	}
+}
@@ -11,3 +11,64 @@ var SecondaryStoreCounter = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "secondary_store_read_through_total",
 	Help: "The total requests that read through to the secondary store.",
 })
+
+// SecondaryStoreOutcomeCounter keeps a count of how each read-through to a
+// later store ended, or why an error wasn't read through, by store name
+var SecondaryStoreOutcomeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "secondary_store_read_through_outcome_total",
+	Help: "The total read-throughs to later stores by store and outcome.",
+}, []string{"store", "outcome"})
+
+// BackfillCounter keeps a count of the copies of read-through objects into
+// cache stores by store name and result
+var BackfillCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "primary_store_backfill_total",
+	Help: "The total copies of read-through objects into cache stores by store and result.",
+}, []string{"store", "result"})
+
+// DiskCacheCounter keeps a count of the downloads looked up in the disk
+// cache by result: hit, miss, or stale when revalidation found it changed
+var DiskCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "disk_cache_requests_total",
+	Help: "The total downloads looked up in the disk cache by result.",
+}, []string{"result"})
+
+// DiskCacheEvictionCounter keeps a count of the objects evicted from the
+// disk cache to make room for others
+var DiskCacheEvictionCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "disk_cache_evictions_total",
+	Help: "The total objects evicted from the disk cache.",
+})
+
+// DiskCacheBytes is the size of the objects held in the disk cache
+var DiskCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "disk_cache_bytes",
+	Help: "The size in bytes of the objects held in the disk cache.",
+})
+
+// MemoryCacheCounter keeps a count of the downloads looked up in the memory
+// cache by result: hit or miss
+var MemoryCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "memory_cache_requests_total",
+	Help: "The total downloads looked up in the memory cache by result.",
+}, []string{"result"})
+
+// MemoryCacheBytes is the size of the objects held in the memory cache
+var MemoryCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "memory_cache_bytes",
+	Help: "The size in bytes of the objects held in the memory cache.",
+})
+
+// CoalescedCounter keeps a count of GETs by their part in a coalesced read:
+// the leader making it, those joining it, or those falling back to their own
+var CoalescedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coalesced_requests_total",
+	Help: "The total GETs sharing a read from the stores by role.",
+}, []string{"result"})
+
+// RedirectCounter keeps a count of the downloads redirected to a presigned
+// URL by the store they were redirected to
+var RedirectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "download_redirects_total",
+	Help: "The total downloads redirected to a presigned URL by store.",
+}, []string{"store"})
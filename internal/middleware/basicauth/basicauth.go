@@ -0,0 +1,61 @@
+// Package basicauth guards routes behind HTTP basic authentication
+package basicauth
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"github.com/packethost/aws-s3-proxy/internal/auth"
+)
+
+// BasicAuth creates an echo middleware that applies the read or write policy
+// to each request by its method. Requests for any of the public paths, like
+// health checks, are always let through, as are requests needing credentials
+// made with a verified client certificate that a rule grants access to.
+func BasicAuth(a auth.Authenticator, p auth.Policies, rules auth.CertRules, public ...string) echo.MiddlewareFunc {
+	basic := middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Realm: "aws-s3-proxy",
+		Validator: func(u, p string, e echo.Context) (bool, error) {
+			if !a.Authenticate(u, p) {
+				return false, nil
+			}
+
+			e.Set(auth.UserKey, u)
+
+			return true, nil
+		},
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		guarded := basic(next)
+
+		return func(e echo.Context) error {
+			req := e.Request()
+
+			for _, path := range public {
+				if path != "" && req.URL.Path == path {
+					return next(e)
+				}
+			}
+
+			method := auth.AccessMethod(req)
+
+			switch p.For(method) {
+			case auth.PolicyPublic:
+				return next(e)
+			case auth.PolicyDeny:
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+
+			if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && rules.Allow(method, req.TLS.VerifiedChains[0][0]) {
+				e.Set(auth.UserKey, "cert:"+req.TLS.VerifiedChains[0][0].Subject.CommonName)
+
+				return next(e)
+			}
+
+			return guarded(e)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"github.com/packethost/aws-s3-proxy/internal/auth"
 )
 
 // ZapLogger gives access style logs for an echo router
@@ -34,6 +36,10 @@ func ZapLogger(log *zap.Logger) echo.MiddlewareFunc {
 				zap.String("user_agent", req.UserAgent()),
 			}
 
+			if user, ok := c.Get(auth.UserKey).(string); ok {
+				fields = append(fields, zap.String("user", user))
+			}
+
 			id := req.Header.Get(echo.HeaderXRequestID)
 			if id == "" {
 				id = res.Header().Get(echo.HeaderXRequestID)
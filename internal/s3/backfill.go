@@ -0,0 +1,361 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+)
+
+// Results of a backfill, as labeled on the backfill counter
+const (
+	backfillCopied       = "copied"
+	backfillDeduplicated = "deduplicated"
+	backfillDropped      = "dropped"
+	backfillSkipped      = "skipped"
+	backfillFailed       = "failed"
+)
+
+var errTooLargeToCache = errors.New("object is too large to cache")
+
+// errBackfillIncomplete means the download feeding a backfill ended before
+// the whole object was read
+var errBackfillIncomplete = errors.New("download ended before the whole object was read")
+
+// backfillJob copies a key read from a later store into the cache stores in
+// front of it, from the spool the download filled as the client read it
+type backfillJob struct {
+	key     string
+	source  *config.Bucket
+	targets []*config.Bucket
+	info    ObjectInfo
+	spool   *backfillSpool
+}
+
+// backfiller copies objects read through from a later store into the cache
+// stores with a bounded pool of background workers. Each key is only queued
+// once while it is waiting or being copied.
+type backfiller struct {
+	once     sync.Once
+	jobs     chan backfillJob
+	mu       sync.Mutex
+	inflight map[string]struct{}
+	// buffered is how many bytes of downloads are held in memory
+	buffered atomic.Int64
+}
+
+var backfills = &backfiller{}
+
+func (b *backfiller) start() {
+	rt := config.Cfg.ReadThrough
+
+	b.jobs = make(chan backfillJob, max(rt.BackfillQueueSize, 0))
+	b.inflight = map[string]struct{}{}
+
+	for i := 0; i < max(rt.BackfillWorkers, 1); i++ {
+		go b.work()
+	}
+}
+
+// cacheTargets returns the cache stores listed before source
+func cacheTargets(source *config.Bucket) []*config.Bucket {
+	c := config.Cfg
+
+	var targets []*config.Bucket
+
+	for i := range c.Stores {
+		store := &c.Stores[i]
+		if store == source {
+			break
+		}
+
+		if store.Has(config.RoleCache) {
+			targets = append(targets, store)
+		}
+	}
+
+	return targets
+}
+
+// enqueue schedules a copy of an object read from source, fed by its body
+// as the client reads it rather than by another read from the store. The
+// body is held until the client has read it all, and only then queued for
+// a worker, so that slow clients never hold up the workers. There is no
+// copy when there is nowhere to copy it, it is only part of the object, it
+// is already scheduled or the queue is full.
+func (b *backfiller) enqueue(key string, source *config.Bucket, obj *Object) {
+	c := config.Cfg
+	rt := c.ReadThrough
+
+	targets := cacheTargets(source)
+	if len(targets) == 0 {
+		return
+	}
+
+	skip := func(format string, args ...any) {
+		c.Logger.Debugf("not caching %s: "+format, append([]any{key}, args...)...)
+
+		for _, target := range targets {
+			recordBackfill(target, backfillSkipped)
+		}
+	}
+
+	switch {
+	case obj.ContentRange != "":
+		skip("only %s was read", obj.ContentRange)
+
+		return
+	case rt.MaxCacheSize > 0 && obj.Size > rt.MaxCacheSize:
+		skip("%d bytes is over the %d byte limit", obj.Size, rt.MaxCacheSize)
+
+		return
+	}
+
+	b.once.Do(b.start)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.inflight[key]; ok {
+		for _, target := range targets {
+			recordBackfill(target, backfillDeduplicated)
+		}
+
+		return
+	}
+
+	b.inflight[key] = struct{}{}
+
+	job := backfillJob{key: key, source: source, targets: targets, info: obj.ObjectInfo}
+	job.spool = &backfillSpool{b: b, dir: rt.SpoolDir, max: rt.MaxCacheSize, done: func(err error) { b.ready(job, err) }}
+	obj.Body = &backfillTee{ReadCloser: obj.Body, spool: job.spool, size: obj.Size}
+}
+
+// ready queues a copy once its spool is complete, or gives it up
+func (b *backfiller) ready(job backfillJob, err error) {
+	c := config.Cfg
+
+	if err == nil {
+		select {
+		case b.jobs <- job:
+			return
+		default:
+			c.Logger.Warnf("backfill queue is full, not caching %s", job.key)
+		}
+	}
+
+	for _, target := range job.targets {
+		switch {
+		case err == nil:
+			recordBackfill(target, backfillDropped)
+		case errors.Is(err, errTooLargeToCache):
+			c.Logger.Debugf("not caching %s to %s, it is over the %d byte limit", job.key, target.Name, c.ReadThrough.MaxCacheSize)
+			recordBackfill(target, backfillSkipped)
+		default:
+			c.Logger.Debugf("not caching %s to %s: %v", job.key, target.Name, err)
+			recordBackfill(target, backfillFailed)
+		}
+	}
+
+	b.release(job)
+}
+
+// release drops the spool of a copy, letting the key be copied again
+func (b *backfiller) release(job backfillJob) {
+	job.spool.remove()
+
+	b.mu.Lock()
+	delete(b.inflight, job.key)
+	b.mu.Unlock()
+}
+
+func (b *backfiller) work() {
+	for job := range b.jobs {
+		for _, target := range job.targets {
+			b.copy(job, target)
+		}
+
+		b.release(job)
+	}
+}
+
+// copy streams an object from its spool into a store, giving up once the
+// backfill timeout has passed
+func (b *backfiller) copy(job backfillJob, target *config.Bucket) {
+	c := config.Cfg
+	rt := c.ReadThrough
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if rt.BackfillTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, rt.BackfillTimeout)
+	}
+
+	defer cancel()
+
+	if _, err := put(ctx, target, &job.key, job.spool.reader(), copyOptions(&job.info)); err != nil {
+		c.Logger.Errorf("read through cache save of %s from %s to %s failed: %v", job.key, job.source.Name, target.Name, err)
+		recordBackfill(target, backfillFailed)
+
+		return
+	}
+
+	c.Logger.Debugf("cached object %s to %s", job.key, target.Name)
+	recordBackfill(target, backfillCopied)
+}
+
+// backfillSpool holds a download while it is read by the client, until it
+// can be copied to the cache stores. It is kept in memory while the
+// backfiller's memory budget allows, and moved to a file otherwise.
+type backfillSpool struct {
+	b   *backfiller
+	dir string
+	max int64
+	// done is called once, when the spool is complete or failed
+	done func(error)
+
+	mem     []byte
+	f       *os.File
+	written int64
+	ended   bool
+}
+
+// write appends to the spool, failing it once it grows beyond max bytes
+func (s *backfillSpool) write(p []byte) {
+	if s.ended {
+		return
+	}
+
+	if s.max > 0 && s.written+int64(len(p)) > s.max {
+		s.finish(errTooLargeToCache)
+
+		return
+	}
+
+	if err := s.store(p); err != nil {
+		s.finish(err)
+
+		return
+	}
+
+	s.written += int64(len(p))
+}
+
+func (s *backfillSpool) store(p []byte) error {
+	if s.f == nil {
+		budget := config.Cfg.ReadThrough.BackfillMemory
+		if s.b.buffered.Add(int64(len(p))) <= budget {
+			s.mem = append(s.mem, p...)
+
+			return nil
+		}
+
+		s.b.buffered.Add(-int64(len(p)))
+
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.f.Write(p)
+
+	return err
+}
+
+// spill moves what is held in memory to a file, past the memory budget
+func (s *backfillSpool) spill() error {
+	f, err := os.CreateTemp(s.dir, "aws-s3-proxy-*")
+	if err != nil {
+		return err
+	}
+
+	s.f = f
+
+	_, err = f.Write(s.mem)
+	s.b.buffered.Add(-int64(len(s.mem)))
+	s.mem = nil
+
+	return err
+}
+
+// finish ends the spool, which is complete when err is nil
+func (s *backfillSpool) finish(err error) {
+	if s.ended {
+		return
+	}
+
+	s.ended = true
+	s.done(err)
+}
+
+// reader reads a complete spool from the start
+func (s *backfillSpool) reader() io.Reader {
+	if s.f == nil {
+		return bytes.NewReader(s.mem)
+	}
+
+	return io.NewSectionReader(s.f, 0, s.written)
+}
+
+func (s *backfillSpool) remove() {
+	s.b.buffered.Add(-int64(len(s.mem)))
+	s.mem = nil
+
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+	}
+}
+
+// backfillTee fills a spool with the body of a download as it is read. A
+// download that fails part way, or is shorter than the object, fails the
+// spool so that the copy is abandoned and no partial object gets cached.
+type backfillTee struct {
+	io.ReadCloser
+	spool *backfillSpool
+	size  int64
+	n     int64
+}
+
+func (t *backfillTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	if n > 0 {
+		t.spool.write(p[:n])
+		t.n += int64(n)
+	}
+
+	switch {
+	case errors.Is(err, io.EOF) && t.size >= 0 && t.n != t.size:
+		t.spool.finish(errBackfillIncomplete)
+	case errors.Is(err, io.EOF):
+		t.spool.finish(nil)
+	case err != nil:
+		t.spool.finish(err)
+	}
+
+	return n, err
+}
+
+// Close fails the spool if the client hung up before the end. A body of
+// known size read in full is complete even if it was never read to EOF.
+func (t *backfillTee) Close() error {
+	err := t.ReadCloser.Close()
+
+	if t.size >= 0 && t.n == t.size {
+		t.spool.finish(nil)
+	}
+
+	t.spool.finish(errBackfillIncomplete)
+
+	return err
+}
+
+func recordBackfill(store *config.Bucket, result string) {
+	metrics.BackfillCounter.WithLabelValues(store.Name, result).Inc()
+}
@@ -0,0 +1,187 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestBackfillSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{ReadThrough: config.ReadThrough{BackfillMemory: 4}}
+
+	b := &backfiller{}
+
+	var ended []error
+
+	spool := func(max int64) *backfillSpool {
+		return &backfillSpool{b: b, dir: dir, max: max, done: func(err error) { ended = append(ended, err) }}
+	}
+
+	// held in memory while it fits
+	small := spool(0)
+	small.write([]byte("pay"))
+	small.finish(nil)
+
+	got, err := io.ReadAll(small.reader())
+	require.NoError(t, err)
+	assert.Equal(t, "pay", string(got))
+	assert.Equal(t, int64(3), b.buffered.Load())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// and moved to disk past the memory budget
+	large := spool(0)
+	large.write([]byte("pay"))
+	large.write([]byte("load"))
+	large.finish(nil)
+
+	got, err = io.ReadAll(large.reader())
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(got))
+	assert.Equal(t, int64(3), b.buffered.Load())
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	tooLarge := spool(4)
+	tooLarge.write([]byte("too long"))
+	tooLarge.finish(nil)
+
+	assert.Equal(t, []error{nil, nil, errTooLargeToCache}, ended)
+
+	for _, s := range []*backfillSpool{small, large, tooLarge} {
+		s.remove()
+	}
+
+	assert.Zero(t, b.buffered.Load())
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestBackfill(t *testing.T) {
+	cache, origin := t.TempDir(), t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{
+			{Name: "cache", Type: config.StoreTypeFilesystem, Directory: cache, Roles: []string{config.RoleRead, config.RoleCache}},
+			{Name: "origin", Type: config.StoreTypeFilesystem, Directory: origin, Roles: []string{config.RoleRead}},
+		},
+		ReadThrough: config.ReadThrough{SpoolDir: t.TempDir(), BackfillQueueSize: 4, BackfillTimeout: time.Minute},
+	}
+
+	for _, key := range []string{"whole.txt", "ranged.txt", "slow.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(origin, key), []byte("payload"), 0o600))
+	}
+
+	b := &backfiller{}
+	source := &config.Cfg.Stores[1]
+
+	download := func(key, spec string) {
+		obj, err := storeFor(source).Get(context.Background(), key, GetOptions{Range: spec})
+		require.NoError(t, err)
+
+		b.enqueue(key, source, obj)
+
+		_, err = io.Copy(io.Discard, obj.Body)
+		require.NoError(t, err)
+		obj.Body.Close()
+	}
+
+	// a client still reading holds no worker
+	slow, err := storeFor(source).Get(context.Background(), "slow.txt", GetOptions{})
+	require.NoError(t, err)
+
+	b.enqueue("slow.txt", source, slow)
+
+	_, err = io.CopyN(io.Discard, slow.Body, 3)
+	require.NoError(t, err)
+
+	download("ranged.txt", "bytes=0-2")
+	download("whole.txt", "")
+
+	assert.Eventually(t, func() bool {
+		got, err := os.ReadFile(filepath.Join(cache, "whole.txt"))
+
+		return err == nil && string(got) == "payload"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoFileExists(t, filepath.Join(cache, "ranged.txt"))
+	assert.NoFileExists(t, filepath.Join(cache, "slow.txt"))
+
+	_, err = io.Copy(io.Discard, slow.Body)
+	require.NoError(t, err)
+	slow.Body.Close()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(cache, "slow.txt"))
+
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the spool is gone once copied
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(config.Cfg.ReadThrough.SpoolDir)
+
+		return err == nil && len(entries) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBackfillIncomplete(t *testing.T) {
+	cache := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{
+			{Name: "cache", Type: config.StoreTypeFilesystem, Directory: cache, Roles: []string{config.RoleRead, config.RoleCache}},
+			{Name: "origin", Type: config.StoreTypeFilesystem, Directory: t.TempDir(), Roles: []string{config.RoleRead}},
+		},
+		ReadThrough: config.ReadThrough{SpoolDir: t.TempDir(), BackfillQueueSize: 4, BackfillTimeout: time.Minute},
+	}
+
+	b := &backfiller{}
+	source := &config.Cfg.Stores[1]
+
+	download := func(key string, body io.Reader, n int64) {
+		obj := &Object{ObjectInfo: ObjectInfo{Size: 7}, Body: io.NopCloser(body)}
+
+		b.enqueue(key, source, obj)
+
+		_, _ = io.CopyN(io.Discard, obj.Body, n)
+		obj.Body.Close()
+	}
+
+	// the client hangs up, the store fails part way, or sends less than the
+	// object's size
+	download("closed.txt", strings.NewReader("payload"), 3)
+	download("failed.txt", io.MultiReader(strings.NewReader("pay"), iotest.ErrReader(io.ErrUnexpectedEOF)), 7)
+	download("short.txt", strings.NewReader("pay"), 7)
+
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(config.Cfg.ReadThrough.SpoolDir)
+
+		return err == nil && len(entries) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, key := range []string{"closed.txt", "failed.txt", "short.txt"} {
+		assert.NoFileExists(t, filepath.Join(cache, key))
+	}
+}
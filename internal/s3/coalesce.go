@@ -0,0 +1,355 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+)
+
+// Roles of a coalesced request, as labeled on the coalesced counter
+const (
+	coalesceLeader   = "leader"
+	coalesceJoined   = "joined"
+	coalesceFallback = "fallback"
+)
+
+// coalesceHeaders are the request headers that, along with the key, make
+// GETs identical
+var coalesceHeaders = []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+// flightBufferSize is how much of a body is read at a time
+const flightBufferSize = 32 << 10
+
+// errFlightAborted means a shared read can't be joined, so the request is
+// better off on its own
+var errFlightAborted = errors.New("coalesced read aborted")
+
+// flight is a read from the stores shared by identical GETs. Its body is
+// spooled to a temporary file as it arrives, so that requests joining part
+// way through can still send it from the start. The read carries on for as
+// long as any request is attached to it, and can be joined until it ends.
+type flight struct {
+	id     string
+	ready  chan struct{}
+	cancel context.CancelFunc
+
+	// set once ready is closed
+	info  ObjectInfo
+	store int
+	err   error
+
+	mu      sync.Mutex
+	clients int
+	spool   *os.File
+	written int64
+	done    bool
+	readErr error
+	// progress is closed and replaced whenever the spool grows or ends
+	progress chan struct{}
+}
+
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+var inflight = &coalescer{flights: map[string]*flight{}}
+
+func flightID(key string, h http.Header) string {
+	var b strings.Builder
+
+	b.WriteString(cleanKey(key))
+
+	for _, name := range coalesceHeaders {
+		b.WriteByte(0)
+		b.WriteString(h.Get(name))
+	}
+
+	return b.String()
+}
+
+// join attaches to the flight of an identical GET, or starts one reading
+// the key with the given headers. It returns nil when there is a flight that
+// can't be joined any more.
+func (c *coalescer) join(key string, header http.Header) (*flight, bool) {
+	id := flightID(key, header)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.flights[id]; ok {
+		if f.attach() {
+			return f, false
+		}
+
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &flight{id: id, ready: make(chan struct{}), cancel: cancel, clients: 1, progress: make(chan struct{})}
+	c.flights[id] = f
+
+	go f.run(ctx, key, header.Clone())
+
+	return f, true
+}
+
+// forget stops new requests from joining a flight
+func (c *coalescer) forget(f *flight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.flights[f.id] == f {
+		delete(c.flights, f.id)
+	}
+}
+
+// forgetKey stops new requests from joining the flights of a key, once it
+// was written or deleted and they may read what it used to be
+func (c *coalescer) forgetKey(key string) {
+	prefix := cleanKey(key) + "\x00"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id := range c.flights {
+		if strings.HasPrefix(id, prefix) {
+			delete(c.flights, id)
+		}
+	}
+}
+
+// attach joins a flight still reading from the stores. One that is done may
+// be stale by now, so later requests make their own.
+func (f *flight) attach() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.clients == 0 || f.done || f.err != nil || f.readErr != nil {
+		return false
+	}
+
+	f.clients++
+
+	return true
+}
+
+// leave detaches a request, cancelling the read once nobody is left
+func (f *flight) leave() {
+	f.mu.Lock()
+	f.clients--
+	last := f.clients == 0
+	f.mu.Unlock()
+
+	if last {
+		inflight.forget(f)
+		f.cancel()
+	}
+
+	f.cleanup()
+}
+
+// cleanup removes the spool once it is read in full by everyone attached
+func (f *flight) cleanup() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.clients == 0 && f.done && f.spool != nil {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}
+}
+
+// run reads the object through the stores with the headers of the request
+// that started the flight, then pumps its body into the spool
+func (f *flight) run(ctx context.Context, key string, header http.Header) {
+	defer f.cancel()
+
+	obj, i, err := readThrough(key, func(store *config.Bucket) (*Object, error) {
+		return get(ctx, store, &key, header)
+	})
+
+	var spool *os.File
+
+	if err == nil {
+		spool, err = os.CreateTemp(config.Cfg.Coalesce.SpoolDir, "coalesce-*")
+		if err != nil {
+			config.Cfg.Logger.Warnf("unable to spool %s for coalesced requests: %v", key, err)
+			obj.Body.Close()
+
+			err = errFlightAborted
+		}
+	}
+
+	f.mu.Lock()
+	f.spool = spool
+	f.store = i
+	f.err = err
+
+	if obj != nil {
+		f.info = obj.ObjectInfo
+	}
+
+	if err != nil {
+		f.done = true
+	}
+
+	f.mu.Unlock()
+
+	close(f.ready)
+
+	if err == nil {
+		f.pump(obj.Body)
+	}
+
+	inflight.forget(f)
+	f.cleanup()
+}
+
+func (f *flight) pump(body io.ReadCloser) {
+	defer body.Close()
+
+	buf := make([]byte, flightBufferSize)
+
+	for {
+		n, err := body.Read(buf)
+
+		if n > 0 {
+			if _, werr := f.spool.Write(buf[:n]); werr != nil && err == nil {
+				err = werr
+			}
+		}
+
+		f.mu.Lock()
+		f.written += int64(n)
+
+		if err != nil {
+			f.done = true
+
+			if !errors.Is(err, io.EOF) {
+				f.readErr = err
+			}
+		}
+
+		close(f.progress)
+		f.progress = make(chan struct{})
+		f.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// flightReader sends the spooled body of a flight from the start, waiting
+// for more to arrive until the flight is done
+type flightReader struct {
+	ctx    context.Context
+	f      *flight
+	off    int64
+	closed bool
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.f
+
+	for {
+		f.mu.Lock()
+		written, done, readErr, progress, spool := f.written, f.done, f.readErr, f.progress, f.spool
+		f.mu.Unlock()
+
+		switch {
+		case r.off < written:
+			n, err := spool.ReadAt(p[:min(int64(len(p)), written-r.off)], r.off)
+			r.off += int64(n)
+
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+
+			return n, err
+		case done && readErr != nil:
+			return 0, readErr
+		case done:
+			return 0, io.EOF
+		}
+
+		select {
+		case <-progress:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *flightReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.f.leave()
+	}
+
+	return nil
+}
+
+func recordCoalesced(result string) {
+	metrics.CoalescedCounter.WithLabelValues(result).Inc()
+}
+
+// coalescedGet reads an object through the stores like readThrough does,
+// sharing the read with identical GETs in flight at the same time. Requests
+// that can't join a flight make their own read.
+func coalescedGet(req *http.Request, key string) (*Object, int, error) {
+	ownRead := func() (*Object, int, error) {
+		return readThrough(key, func(store *config.Bucket) (*Object, error) {
+			return get(req.Context(), store, &key, req.Header)
+		})
+	}
+
+	if !config.Cfg.Coalesce.Enabled {
+		return ownRead()
+	}
+
+	f, leader := inflight.join(key, req.Header)
+	if f == nil {
+		recordCoalesced(coalesceFallback)
+
+		return ownRead()
+	}
+
+	select {
+	case <-f.ready:
+	case <-req.Context().Done():
+		f.leave()
+
+		return nil, -1, req.Context().Err()
+	}
+
+	if errors.Is(f.err, errFlightAborted) {
+		f.leave()
+		recordCoalesced(coalesceFallback)
+
+		return ownRead()
+	}
+
+	if leader {
+		recordCoalesced(coalesceLeader)
+	} else {
+		recordCoalesced(coalesceJoined)
+	}
+
+	if f.err != nil {
+		f.leave()
+
+		return nil, -1, f.err
+	}
+
+	return &Object{ObjectInfo: f.info, Body: &flightReader{ctx: req.Context(), f: f}}, f.store, nil
+}
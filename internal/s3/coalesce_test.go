@@ -0,0 +1,109 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestFlightLateJoiner(t *testing.T) {
+	spool, err := os.CreateTemp(t.TempDir(), "coalesce-*")
+	require.NoError(t, err)
+
+	f := &flight{ready: make(chan struct{}), cancel: func() {}, clients: 1, spool: spool, progress: make(chan struct{})}
+	close(f.ready)
+
+	pr, pw := io.Pipe()
+	go f.pump(pr)
+
+	first := &flightReader{ctx: context.Background(), f: f}
+
+	_, err = pw.Write([]byte("hello "))
+	require.NoError(t, err)
+
+	b := make([]byte, 6)
+	_, err = io.ReadFull(first, b)
+	require.NoError(t, err)
+
+	// joining part way still gets the body from the start
+	require.True(t, f.attach())
+
+	late := &flightReader{ctx: context.Background(), f: f}
+
+	go func() {
+		_, _ = pw.Write([]byte("world"))
+		pw.Close()
+	}()
+
+	rest, err := io.ReadAll(first)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(rest))
+
+	all, err := io.ReadAll(late)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(all))
+
+	// a read that is over may be stale, even with clients still attached
+	assert.False(t, f.attach())
+
+	first.Close()
+	late.Close()
+
+	// nobody is left to join
+	assert.False(t, f.attach())
+
+	_, err = os.Stat(spool.Name())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCoalescedGet(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "release.iso"), []byte("payload"), 0o600))
+
+	config.Cfg = &config.Config{
+		Stores:   []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead}}},
+		Coalesce: config.Coalesce{Enabled: true, SpoolDir: t.TempDir()},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/release.iso", http.NoBody)
+
+	obj, i, err := coalescedGet(req, "/release.iso")
+	require.NoError(t, err)
+	assert.Equal(t, 0, i)
+	assert.Equal(t, int64(7), obj.Size)
+
+	b, err := io.ReadAll(obj.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(b))
+	obj.Body.Close()
+
+	_, _, err = coalescedGet(req, "/missing.iso")
+	assert.True(t, isNotFound(err))
+
+	spooled, err := os.ReadDir(config.Cfg.Coalesce.SpoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, spooled)
+	assert.Empty(t, inflight.flights)
+}
+
+func TestForgetKey(t *testing.T) {
+	c := &coalescer{flights: map[string]*flight{}}
+
+	for _, id := range []string{flightID("/a.iso", http.Header{}), flightID("/a.iso", http.Header{"Range": {"bytes=0-9"}}), flightID("/a.isox", http.Header{})} {
+		c.flights[id] = &flight{id: id}
+	}
+
+	c.forgetKey("a.iso")
+
+	assert.Len(t, c.flights, 1)
+	assert.Contains(t, c.flights, flightID("/a.isox", http.Header{}))
+}
@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// getOptions forwards the range and conditional headers of a client request
+// onto a store read
+func getOptions(h http.Header) GetOptions {
+	var opts GetOptions
+
+	if h == nil {
+		return opts
+	}
+
+	opts.Range = h.Get("Range")
+	opts.IfMatch = h.Get("If-Match")
+	opts.IfNoneMatch = h.Get("If-None-Match")
+
+	if t, err := http.ParseTime(h.Get("If-Modified-Since")); err == nil {
+		opts.IfModifiedSince = t
+	}
+
+	if t, err := http.ParseTime(h.Get("If-Unmodified-Since")); err == nil {
+		opts.IfUnmodifiedSince = t
+	}
+
+	return opts
+}
+
+// setIfRange applies an If-Range header. S3 doesn't support it, so the
+// validator is sent as If-Match or If-Unmodified-Since along with the range,
+// and a failed precondition means the whole object should be sent instead.
+// It returns whether the request needs that fallback.
+func setIfRange(opts *GetOptions, h http.Header) bool {
+	v := h.Get("If-Range")
+	if v == "" || opts.Range == "" {
+		return false
+	}
+
+	// If-Range only matches strong validators
+	if strings.HasPrefix(v, "W/") {
+		opts.Range = ""
+
+		return false
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if !opts.IfUnmodifiedSince.IsZero() {
+			return false
+		}
+
+		opts.IfUnmodifiedSince = t
+
+		return true
+	}
+
+	if opts.IfMatch != "" {
+		return false
+	}
+
+	opts.IfMatch = v
+
+	return true
+}
+
+// ifRangeMatches reports whether the If-Range validator of a request, if
+// any, matches an object held locally, so that the range is sent rather
+// than the whole object
+func ifRangeMatches(info *ObjectInfo, v string) bool {
+	if v == "" {
+		return true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return info.LastModified.Truncate(time.Second).Equal(t)
+	}
+
+	// If-Range only matches strong validators
+	return !strings.HasPrefix(v, "W/") && v == info.ETag
+}
@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetOptions(t *testing.T) {
+	h := http.Header{}
+	h.Set("Range", "bytes=0-9")
+	h.Set("If-None-Match", `"abc"`)
+	h.Set("If-Modified-Since", "Sat, 17 Oct 2026 18:00:00 GMT")
+	h.Set("If-Unmodified-Since", "not a date")
+
+	opts := getOptions(h)
+
+	assert.Equal(t, "bytes=0-9", opts.Range)
+	assert.Equal(t, `"abc"`, opts.IfNoneMatch)
+	assert.Empty(t, opts.IfMatch)
+	assert.Equal(t, 2026, opts.IfModifiedSince.Year())
+	assert.True(t, opts.IfUnmodifiedSince.IsZero())
+}
+
+func TestSetIfRange(t *testing.T) {
+	opts := GetOptions{Range: "bytes=0-9"}
+	assert.True(t, setIfRange(&opts, http.Header{"If-Range": {`"abc"`}}))
+	assert.Equal(t, `"abc"`, opts.IfMatch)
+
+	opts = GetOptions{Range: "bytes=0-9"}
+	assert.True(t, setIfRange(&opts, http.Header{"If-Range": {"Sat, 17 Oct 2026 18:00:00 GMT"}}))
+	assert.False(t, opts.IfUnmodifiedSince.IsZero())
+
+	opts = GetOptions{Range: "bytes=0-9"}
+	assert.False(t, setIfRange(&opts, http.Header{"If-Range": {`W/"abc"`}}))
+	assert.Empty(t, opts.Range)
+
+	opts = GetOptions{}
+	assert.False(t, setIfRange(&opts, http.Header{"If-Range": {`"abc"`}}))
+	assert.Empty(t, opts.IfMatch)
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	modified, _ := http.ParseTime("Sat, 17 Oct 2026 18:00:00 GMT")
+	info := &ObjectInfo{ETag: `"abc"`, LastModified: modified.Add(300 * time.Millisecond)}
+
+	assert.True(t, ifRangeMatches(info, ""))
+	assert.True(t, ifRangeMatches(info, `"abc"`))
+	assert.True(t, ifRangeMatches(info, "Sat, 17 Oct 2026 18:00:00 GMT"))
+	assert.False(t, ifRangeMatches(info, `W/"abc"`))
+	assert.False(t, ifRangeMatches(info, `"def"`))
+	assert.False(t, ifRangeMatches(info, "Sat, 17 Oct 2026 17:00:00 GMT"))
+}
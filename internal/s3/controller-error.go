@@ -1,26 +1,223 @@
 package s3
 
 import (
-	"log"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
 	"net/http"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+const (
+	// statusClientClosedRequest is nginx's status for a client that hung up
+	statusClientClosedRequest = 499
+
+	errCodeAccessDenied       = "AccessDenied"
+	errCodeEntityTooLarge     = "EntityTooLarge"
+	errCodeIncompleteBody     = "IncompleteBody"
+	errCodeInternalError      = "InternalError"
+	errCodeInvalidArgument    = "InvalidArgument"
+	errCodeInvalidRange       = "InvalidRange"
+	errCodeMalformedXML       = "MalformedXML"
+	errCodeMissingLength      = "MissingContentLength"
+	errCodeNotFound           = "NotFound"
+	errCodeNoSuchBucket       = "NoSuchBucket"
+	errCodeNoSuchKey          = "NoSuchKey"
+	errCodeNoSuchUpload       = "NoSuchUpload"
+	errCodeNotImplemented     = "NotImplemented"
+	errCodeNotModified        = "NotModified"
+	errCodePreconditionFailed = "PreconditionFailed"
+	errCodeRequestCanceled    = "RequestCanceled"
+	errCodeRequestError       = "RequestError"
+	errCodeRequestTimeout     = "RequestTimeout"
+	errCodeServiceUnavailable = "ServiceUnavailable"
+	errCodeSlowDown           = "SlowDown"
 )
 
+// errorStatus is the HTTP status for each S3 error code we translate
+var errorStatus = map[string]int{
+	errCodeAccessDenied:       http.StatusForbidden,
+	errCodeEntityTooLarge:     http.StatusRequestEntityTooLarge,
+	errCodeIncompleteBody:     http.StatusBadRequest,
+	errCodeInvalidRange:       http.StatusRequestedRangeNotSatisfiable,
+	errCodeMalformedXML:       http.StatusBadRequest,
+	errCodeMissingLength:      http.StatusLengthRequired,
+	errCodeNotFound:           http.StatusNotFound,
+	errCodeNotImplemented:     http.StatusNotImplemented,
+	errCodeNotModified:        http.StatusNotModified,
+	errCodePreconditionFailed: http.StatusPreconditionFailed,
+	errCodeRequestCanceled:    statusClientClosedRequest,
+	errCodeRequestTimeout:     http.StatusGatewayTimeout,
+	errCodeServiceUnavailable: http.StatusServiceUnavailable,
+	errCodeSlowDown:           http.StatusServiceUnavailable,
+	errCodeNoSuchBucket:       http.StatusNotFound,
+	errCodeNoSuchKey:          http.StatusNotFound,
+	errCodeNoSuchUpload:       http.StatusNotFound,
+	errCodeInternalError:      http.StatusInternalServerError,
+	errCodeRequestError:       http.StatusBadGateway,
+}
+
+// errorMessage is what clients are told for each S3 error code, so that the
+// SDK's own messages and request details never reach them
+var errorMessage = map[string]string{
+	errCodeAccessDenied:       "Access Denied",
+	errCodeEntityTooLarge:     "Your proposed upload exceeds the maximum allowed object size.",
+	errCodeIncompleteBody:     "The request body terminated unexpectedly",
+	errCodeInternalError:      "We encountered an internal error. Please try again.",
+	errCodeInvalidArgument:    "Invalid Argument",
+	errCodeInvalidRange:       "The requested range is not satisfiable",
+	errCodeMalformedXML:       "The XML you provided was not well-formed or did not validate against our published schema.",
+	errCodeMissingLength:      "You must provide the Content-Length HTTP header.",
+	errCodeNotImplemented:     "A header or query you provided implies functionality that is not implemented.",
+	errCodeNotFound:           "Not Found",
+	errCodePreconditionFailed: "At least one of the pre-conditions you specified did not hold",
+	errCodeRequestCanceled:    "The request was canceled",
+	errCodeRequestTimeout:     "The upstream request timed out",
+	errCodeServiceUnavailable: "Please reduce your request rate.",
+	errCodeSlowDown:           "Please reduce your request rate.",
+	errCodeNoSuchBucket:       "The specified bucket does not exist",
+	errCodeNoSuchKey:          "The specified key does not exist.",
+	errCodeNoSuchUpload:       "The specified upload does not exist.",
+	errCodeRequestError:       "We encountered an internal error. Please try again.",
+}
+
+// errorResponse is the body of an S3 style error
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error" json:"-"`
+	Code      string   `xml:"Code" json:"code"`
+	Message   string   `xml:"Message" json:"message"`
+	Resource  string   `xml:"Resource,omitempty" json:"resource,omitempty"`
+	RequestID string   `xml:"RequestId,omitempty" json:"requestId,omitempty"`
+}
+
+// toHTTPError translates an error from S3, or from talking to it, into the
+// HTTP status and S3 error code to answer the client with
 func toHTTPError(err error) (int, string) {
-	if aerr, ok := err.(awserr.Error); ok {
-		switch aerr.Code() {
-		case s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchKey:
-			return http.StatusNotFound, aerr.Error()
-		}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest, errCodeRequestCanceled
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return http.StatusGatewayTimeout, errCodeRequestTimeout
+	}
+
+	var serr *Error
+	if !errors.As(err, &serr) {
+		return http.StatusInternalServerError, errCodeInternalError
+	}
+
+	if status, ok := errorStatus[serr.Code]; ok {
+		return status, serr.Code
+	}
+
+	// Codes we don't know still come with the status S3 answered with
+	if serr.Status >= http.StatusBadRequest {
+		return serr.Status, serr.Code
+	}
+
+	return http.StatusInternalServerError, errCodeInternalError
+}
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// writeError answers a request that failed talking to S3 with an S3 style
+// error, as JSON if the client accepts it and XML otherwise
+func writeError(e echo.Context, err error) error {
+	c := config.Cfg
+	req := e.Request()
+	status, code := toHTTPError(err)
+
+	switch {
+	case status >= http.StatusInternalServerError:
+		c.Logger.Errorf("%s %s failed with %d %s: %v", req.Method, req.URL.Path, status, code, err)
+	default:
+		c.Logger.Debugf("%s %s failed with %d %s: %v", req.Method, req.URL.Path, status, code, err)
+	}
 
-		log.Print("unknown s3 error")
+	// A 304 stands for the object, and carries its validators
+	var serr *Error
+	if status == http.StatusNotModified && errors.As(err, &serr) && serr.Info != nil {
+		h := c.HTTPOpts
+		setValidatorHeaders(e.Response(), serr.Info, h.HTTPCacheControl, h.HTTPExpires)
+	}
+
+	return writeErrorResponse(e, status, code)
+}
+
+// writeErrorResponse sends an S3 style error with the given status and code
+func writeErrorResponse(e echo.Context, status int, code string) error {
+	req := e.Request()
 
-		return http.StatusInternalServerError, aerr.Error()
+	// Nobody is listening, and some statuses can't have a body
+	if status == statusClientClosedRequest || status == http.StatusNotModified || req.Method == http.MethodHead {
+		return e.NoContent(status)
 	}
 
-	log.Print("unknown http error")
+	message, ok := errorMessage[code]
+	if !ok {
+		message = http.StatusText(status)
+	}
+
+	body := &errorResponse{
+		Code:      code,
+		Message:   message,
+		Resource:  req.URL.Path,
+		RequestID: e.Response().Header().Get(echo.HeaderXRequestID),
+	}
+
+	return writeResult(e, status, body)
+}
+
+// writeResult sends the body of an S3 style answer, as JSON if the client
+// accepts it and XML otherwise
+func writeResult(e echo.Context, status int, body any) error {
+	if strings.Contains(e.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return e.JSON(status, body)
+	}
+
+	return e.XML(status, body)
+}
+
+// isNotFound reports whether a store error means the object doesn't exist
+func isNotFound(err error) bool {
+	var serr *Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+
+	switch serr.Code {
+	case errCodeNoSuchKey, errCodeNotFound:
+		return true
+	}
+
+	return serr.Status == http.StatusNotFound
+}
+
+// statusOf returns the HTTP status of a failed store request, or 0
+func statusOf(err error) int {
+	var serr *Error
+	if errors.As(err, &serr) {
+		return serr.Status
+	}
+
+	return 0
+}
+
+// conditionalStatus reports whether an S3 error is the answer to a
+// conditional request rather than a failure, and the status to send for it
+func conditionalStatus(err error) (int, bool) {
+	switch status := statusOf(err); status {
+	case http.StatusNotModified, http.StatusPreconditionFailed:
+		return status, true
+	}
 
-	return http.StatusInternalServerError, err.Error()
+	return 0, false
 }
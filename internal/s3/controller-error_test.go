@@ -1,20 +1,25 @@
 package s3
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
 )
 
 func TestToHTTPError(t *testing.T) {
 	expectedCode := http.StatusInternalServerError
-	expectedMsg := "test"
+	expectedMsg := errCodeInternalError
 
-	code, msg := toHTTPError(errors.New(expectedMsg)) //nolint:goerr113
+	code, msg := toHTTPError(errors.New("test")) //nolint:goerr113
 
 	assert.Equal(t, expectedCode, code)
 	assert.Equal(t, expectedMsg, msg)
@@ -22,39 +27,89 @@ func TestToHTTPError(t *testing.T) {
 
 func TestToHTTPNoSuchBucketError(t *testing.T) {
 	expectedCode := http.StatusNotFound
-	expectedMsg := "NoSuchBucket: 2\ncaused by: 1"
+	expectedMsg := errCodeNoSuchBucket
 
-	code, msg := toHTTPError(awserr.New(
-		s3.ErrCodeNoSuchBucket,
-		"2",
-		errors.New("1"), //nolint:goerr113
-	))
+	code, msg := toHTTPError(&Error{
+		Code: errCodeNoSuchBucket,
+		Err:  errors.New("1"), //nolint:goerr113
+	})
 	assert.Equal(t, expectedCode, code)
 	assert.Equal(t, expectedMsg, msg)
 }
 
 func TestToHTTPNoSuchKeyError(t *testing.T) {
 	expectedCode := http.StatusNotFound
-	expectedMsg := "NoSuchKey: 2\ncaused by: 1"
+	expectedMsg := errCodeNoSuchKey
 
-	code, msg := toHTTPError(awserr.New(
-		s3.ErrCodeNoSuchKey,
-		"2",
-		errors.New("1"), //nolint:goerr113
-	))
+	code, msg := toHTTPError(&Error{
+		Code: errCodeNoSuchKey,
+		Err:  errors.New("1"), //nolint:goerr113
+	})
 	assert.Equal(t, expectedCode, code)
 	assert.Equal(t, expectedMsg, msg)
 }
 
 func TestToHTTPNoSuchUploadError(t *testing.T) {
-	expectedCode := http.StatusInternalServerError
-	expectedMsg := "NoSuchUpload: 2\ncaused by: 1"
+	expectedCode := http.StatusNotFound
+	expectedMsg := errCodeNoSuchUpload
 
-	code, msg := toHTTPError(awserr.New(
-		s3.ErrCodeNoSuchUpload,
-		"2",
-		errors.New("1"), //nolint:goerr113
-	))
+	code, msg := toHTTPError(&Error{
+		Code: errCodeNoSuchUpload,
+		Err:  errors.New("1"), //nolint:goerr113
+	})
 	assert.Equal(t, expectedCode, code)
 	assert.Equal(t, expectedMsg, msg)
 }
+
+func TestToHTTPRequestFailureError(t *testing.T) {
+	tests := []struct {
+		code           string
+		status         int
+		expectedStatus int
+	}{
+		{errCodeAccessDenied, http.StatusForbidden, http.StatusForbidden},
+		{errCodeInvalidRange, http.StatusRequestedRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable},
+		{errCodePreconditionFailed, http.StatusPreconditionFailed, http.StatusPreconditionFailed},
+		{errCodeSlowDown, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"SomethingNew", http.StatusConflict, http.StatusConflict},
+		{"SomethingNew", 0, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		code, msg := toHTTPError(&Error{Code: tt.code, Status: tt.status})
+
+		assert.Equal(t, tt.expectedStatus, code, tt.code)
+
+		if tt.expectedStatus != http.StatusInternalServerError {
+			assert.Equal(t, tt.code, msg)
+		}
+	}
+}
+
+func TestToHTTPCanceledError(t *testing.T) {
+	code, msg := toHTTPError(&Error{Code: errCodeRequestError, Err: context.Canceled})
+	assert.Equal(t, statusClientClosedRequest, code)
+	assert.Equal(t, errCodeRequestCanceled, msg)
+
+	code, msg = toHTTPError(&Error{Code: errCodeRequestError, Err: context.DeadlineExceeded})
+	assert.Equal(t, http.StatusGatewayTimeout, code)
+	assert.Equal(t, errCodeRequestTimeout, msg)
+}
+
+func TestWriteNotModified(t *testing.T) {
+	config.Cfg = &config.Config{Logger: zap.NewNop().Sugar(), HTTPOpts: config.HTTPOpts{HTTPCacheControl: "max-age=60"}}
+
+	modified, _ := http.ParseTime("Sat, 17 Oct 2026 18:00:00 GMT")
+	info := &ObjectInfo{ETag: `"abc"`, LastModified: modified, Expires: "Sun, 18 Oct 2026 18:00:00 GMT"}
+
+	req := httptest.NewRequest(http.MethodGet, "/a.txt", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, writeError(echo.New().NewContext(req, rec), checkConditions(info, GetOptions{IfNoneMatch: `"abc"`})))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, `"abc"`, rec.Header().Get("ETag"))
+	assert.Equal(t, "Sat, 17 Oct 2026 18:00:00 GMT", rec.Header().Get("Last-Modified"))
+	assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "Sun, 18 Oct 2026 18:00:00 GMT", rec.Header().Get("Expires"))
+	assert.Empty(t, rec.Body.String())
+}
@@ -1,228 +1,290 @@
 package s3
 
 import (
-	"bytes"
-	"context"
+	"errors"
 	"io"
 	"net/http"
-	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/labstack/echo/v4"
 
 	"github.com/packethost/aws-s3-proxy/internal/config"
-	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
 )
 
-var getStatus *regexp.Regexp
+// metadataHeaderPrefix marks the headers carrying user metadata
+const metadataHeaderPrefix = "x-amz-meta-"
 
-func init() {
-	getStatus = regexp.MustCompile(`status code: (?P<status>\d\d\d),`)
-}
-
-func storeObject(e echo.Context, r io.Reader, path *string) error {
+// AwsS3Get handles download requests
+func AwsS3Get(e echo.Context) error {
 	c := config.Cfg
+	req := e.Request()
+	key := req.URL.Path
 
-	// tee the stream
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
+	// Directory paths are served by their index document, or listed
+	if strings.HasSuffix(key, "/") {
+		index, ok := resolveIndex(req.Context(), key)
+		if !ok {
+			if c.HTTPOpts.Listing {
+				return listDirectory(e, key)
+			}
 
-	err := e.Stream(http.StatusOK, echo.MIMEOctetStream, tee)
-	if err != nil {
-		e.Error(err)
+			return notFound(e, key)
+		}
+
+		key = index
+	}
 
+	if served, err := serveFromMemory(e, key); served {
 		return err
 	}
 
-	c.Logger.Debugf("writing object %s to local cache", *path)
+	if served, err := serveCached(e, key); served {
+		return err
+	}
 
-	_, err = put(context.Background(), &c.PrimaryStore, path, bytes.NewReader(buf.Bytes()))
-	if err != nil {
-		c.Logger.Error("read through cache save failed")
+	if knownMissing(key) {
+		return notFound(e, key)
+	}
 
+	if served, err := redirect(e, key); served {
 		return err
 	}
 
-	return nil
-}
+	stores := c.ReadStores()
 
-func trySecondary(e echo.Context) error {
-	c := config.Cfg
-	h := c.HTTPOpts
-	req := e.Request()
-	res := e.Response()
-	path := &req.URL.Path
+	obj, i, err := coalescedGet(req, key)
+	if err != nil {
+		if isNotFound(err) {
+			return notFound(e, key)
+		}
+
+		return writeError(e, err)
+	}
 
-	// Increment the echo_secondary_store_read_through_total counter
-	metrics.SecondaryStoreCounter.Inc()
+	// copy the object to the cache stores in front of it in the background,
+	// as the client reads it
+	if i > 0 {
+		backfills.enqueue(cleanKey(key), stores[i], obj)
+	}
 
-	// Range header
-	var rangeHeader *string
-	if candidate := req.Header.Get("Range"); candidate != "" {
-		rangeHeader = &candidate
+	if err := keepInMemory(e, stores[i], key, obj); err != nil {
+		return writeError(e, err)
 	}
 
-	get, err := get(req.Context(), &c.SecondaryStore, path, rangeHeader)
-	if err != nil {
-		status := http.StatusInternalServerError
+	objectCache.fill(cleanKey(key), obj)
 
-		if getStatus.Match([]byte(err.Error())) {
-			statusStr := getStatus.FindStringSubmatch(err.Error())
+	return writeObject(e, obj, determineHTTPStatus(&obj.ObjectInfo))
+}
 
-			status, _ = strconv.Atoi(statusStr[1])
+// AwsS3Head handles metadata requests, answering with the same headers as a
+// download without fetching the object
+func AwsS3Head(e echo.Context) error {
+	c := config.Cfg
+	req := e.Request()
+	key := req.URL.Path
+	path := &key
+
+	// Directory paths are described by their index document, or listed
+	if strings.HasSuffix(key, "/") {
+		index, ok := resolveIndex(req.Context(), key)
+		if !ok {
+			if c.HTTPOpts.Listing {
+				return listDirectory(e, key)
+			}
+
+			return notFound(e, key)
 		}
 
-		return e.String(status, err.Error())
+		key = index
 	}
 
-	// stream object to client
-	setHeadersFromAwsResponse(res, get, h.HTTPCacheControl, h.HTTPExpires)
+	if knownMissing(key) {
+		return notFound(e, key)
+	}
 
-	if c.ReadThrough.CacheToPrimary {
-		return storeObject(e, get.Output.Body, path)
+	info, _, err := readThrough(key, func(store *config.Bucket) (*ObjectInfo, error) {
+		return head(req.Context(), store, path, req.Header)
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return notFound(e, key)
+		}
+
+		return writeError(e, err)
 	}
 
-	return e.Stream(http.StatusOK, echo.MIMEOctetStream, get.Output.Body)
+	return writeObject(e, &Object{ObjectInfo: *info, Body: http.NoBody}, http.StatusOK)
 }
 
-// AwsS3Get handles download requests
-func AwsS3Get(e echo.Context) error {
+// AwsS3Put handles upload requests
+func AwsS3Put(e echo.Context) error {
 	c := config.Cfg
-	h := c.HTTPOpts
 	req := e.Request()
 	res := e.Response()
 	path := &req.URL.Path
-	store := &c.PrimaryStore
 
-	// Range header
-	var rangeHeader *string
-	if candidate := req.Header.Get("Range"); candidate != "" {
-		rangeHeader = &candidate
+	defer req.Body.Close()
+
+	var body io.Reader = req.Body
+
+	if limit := c.Upload.MaxObjectSize; limit > 0 {
+		if req.ContentLength > limit {
+			return writeErrorResponse(e, http.StatusRequestEntityTooLarge, errCodeEntityTooLarge)
+		}
+
+		body = http.MaxBytesReader(res.Writer, req.Body, limit)
 	}
 
-	get, err := get(req.Context(), store, path, rangeHeader)
+	// Stream the body to the store, the upload being abandoned if the client
+	// hangs up part way
+	put, err := put(req.Context(), c.WriteStore(), path, uploadBody{r: body}, uploadOptions(req.Header))
 	if err != nil {
-		if c.ReadThrough.Enabled {
-			c.Logger.Errorf("unable to get %s from %s: %v", *path, store.Bucket, err)
-			c.Logger.Info("err in primary, trying secondary")
+		return writeError(e, err)
+	}
 
-			return trySecondary(e)
-		}
+	missingKeys.remove(cleanKey(*path))
+	objectCache.remove(cleanKey(*path))
+	smallObjects.remove(cleanKey(*path))
+	inflight.forgetKey(cleanKey(*path))
 
-		status := http.StatusInternalServerError
+	setStrHeader(res, "ETag", put.ETag)
+	setStrHeader(res, "x-amz-version-id", put.VersionID)
 
-		if getStatus.Match([]byte(err.Error())) {
-			statusStr := getStatus.FindStringSubmatch(err.Error())
+	// S3 answers a browser-style POST with 204 unless told otherwise
+	if req.Method == http.MethodPost {
+		return e.NoContent(http.StatusNoContent)
+	}
+
+	return e.NoContent(http.StatusOK)
+}
+
+// uploadOptions passes the metadata of an upload on to the store. The
+// Content-Encoding is left out, as compressed bodies are decompressed
+// before they get here.
+func uploadOptions(h http.Header) PutOptions {
+	opts := PutOptions{
+		CacheControl:       h.Get("Cache-Control"),
+		ContentDisposition: h.Get("Content-Disposition"),
+		ContentType:        h.Get("Content-Type"),
+	}
+
+	for name, values := range h {
+		if meta, ok := strings.CutPrefix(strings.ToLower(name), metadataHeaderPrefix); ok && meta != "" {
+			if opts.Metadata == nil {
+				opts.Metadata = map[string]string{}
+			}
 
-			status, _ = strconv.Atoi(statusStr[1])
+			opts.Metadata[meta] = strings.Join(values, ",")
 		}
+	}
 
-		c.Logger.Errorf("status %d", status)
+	return opts
+}
 
-		return e.String(status, err.Error())
+// uploadBody tells errors reading an upload from the client apart from
+// errors writing it to the store
+type uploadBody struct {
+	r io.Reader
+}
+
+func (b uploadBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == nil || errors.Is(err, io.EOF) {
+		return n, err
 	}
 
-	setHeadersFromAwsResponse(res, get, h.HTTPCacheControl, h.HTTPExpires)
+	var merr *http.MaxBytesError
+	if errors.As(err, &merr) {
+		return n, &Error{Code: errCodeEntityTooLarge, Err: err}
+	}
 
-	return e.Stream(http.StatusOK, echo.MIMEOctetStream, get.Output.Body)
+	return n, &Error{Code: errCodeIncompleteBody, Err: err}
 }
 
-// AwsS3Put handles upload requests
-func AwsS3Put(e echo.Context) error {
-	c := config.Cfg
-	req := e.Request()
+// writeObject sends the headers of an object with the given status, then
+// streams the body to the client
+func writeObject(e echo.Context, obj *Object, status int) error {
+	h := config.Cfg.HTTPOpts
 	res := e.Response()
-	path := &req.URL.Path
 
-	b, err := io.ReadAll(req.Body)
-	if err != nil {
-		e.Error(err)
-		return err
-	}
-	defer req.Body.Close()
-	// Put a S3 object
-	put, err := put(req.Context(), &c.PrimaryStore, path, bytes.NewReader(b))
-	if err != nil {
-		e.Error(err)
+	defer obj.Body.Close()
 
-		return err
+	setHeadersFromObject(res, &obj.ObjectInfo, h.HTTPCacheControl, h.HTTPExpires)
+
+	if res.Header().Get(echo.HeaderContentType) == "" {
+		res.Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
 	}
 
-	o := put.Output
+	res.WriteHeader(status)
 
-	res.WriteHeader(http.StatusAccepted)
-	setStrHeader(res, "ETag", o.ETag)
-	setStrHeader(res, "VersionID", o.VersionID)
-	setStrHeader(res, "UploadID", &o.UploadID)
-	setStrHeader(res, "Location", &o.Location)
+	_, err := io.Copy(res, obj.Body)
 
-	return nil
+	return err
 }
 
-func setHeadersFromAwsResponse(w http.ResponseWriter, obj *Download, httpCacheControl, httpExpires string) {
-	s := obj.Output
+func setHeadersFromObject(w http.ResponseWriter, obj *ObjectInfo, httpCacheControl, httpExpires string) {
+	setValidatorHeaders(w, obj, httpCacheControl, httpExpires)
+
+	setStrHeader(w, "Accept-Ranges", obj.AcceptRanges)
+	setStrHeader(w, "Content-Disposition", obj.ContentDisposition)
+	setStrHeader(w, "Content-Encoding", obj.ContentEncoding)
+	setStrHeader(w, "Content-Language", obj.ContentLanguage)
+
+	// Fix https://github.com/pottava/aws-s3-proxy/issues/20
+	if len(w.Header().Get("Content-Encoding")) == 0 {
+		setIntHeader(w, "Content-Length", obj.Size)
+	}
+
+	setStrHeader(w, "Content-Range", obj.ContentRange)
+	setStrHeader(w, "Content-Type", obj.ContentType)
+
+	for name, value := range obj.Metadata {
+		setStrHeader(w, metadataHeaderPrefix+name, value)
+	}
+}
 
+// setValidatorHeaders sets the headers a 304 answer shares with a full one
+func setValidatorHeaders(w http.ResponseWriter, obj *ObjectInfo, httpCacheControl, httpExpires string) {
 	// Cache-Control
 	if len(httpCacheControl) > 0 {
-		setStrHeader(w, "Cache-Control", &httpCacheControl)
+		setStrHeader(w, "Cache-Control", httpCacheControl)
 	} else {
-		setStrHeader(w, "Cache-Control", s.CacheControl)
+		setStrHeader(w, "Cache-Control", obj.CacheControl)
 	}
 
 	// Expires
 	if len(httpExpires) > 0 {
-		setStrHeader(w, "Expires", &httpExpires)
+		setStrHeader(w, "Expires", httpExpires)
 	} else {
-		setStrHeader(w, "Expires", s.Expires)
-	}
-
-	setStrHeader(w, "Content-Disposition", s.ContentDisposition)
-	setStrHeader(w, "Content-Encoding", s.ContentEncoding)
-	setStrHeader(w, "Content-Language", s.ContentLanguage)
-
-	// Fix https://github.com/pottava/aws-s3-proxy/issues/20
-	if len(w.Header().Get("Content-Encoding")) == 0 {
-		setIntHeader(w, "Content-Length", s.ContentLength)
+		setStrHeader(w, "Expires", obj.Expires)
 	}
 
-	setStrHeader(w, "Content-Range", s.ContentRange)
-	setStrHeader(w, "Content-Type", s.ContentType)
-	setStrHeader(w, "ETag", s.ETag)
-	setTimeHeader(w, "Last-Modified", s.LastModified)
-
-	w.WriteHeader(determineHTTPStatus(s))
+	setStrHeader(w, "ETag", obj.ETag)
+	setTimeHeader(w, "Last-Modified", obj.LastModified)
 }
 
-func setStrHeader(w http.ResponseWriter, key string, value *string) {
-	if value != nil {
-		if len(*value) > 0 {
-			w.Header().Add(key, *value)
-		}
+func setStrHeader(w http.ResponseWriter, key, value string) {
+	if len(value) > 0 {
+		w.Header().Add(key, value)
 	}
 }
 
-func setIntHeader(w http.ResponseWriter, key string, value *int64) {
-	if value != nil {
-		if *value > 0 {
-			w.Header().Add(key, strconv.FormatInt(*value, 10)) // nolint: gomnd
-		}
+func setIntHeader(w http.ResponseWriter, key string, value int64) {
+	if value > 0 {
+		w.Header().Add(key, strconv.FormatInt(value, 10)) // nolint: gomnd
 	}
 }
 
-func setTimeHeader(w http.ResponseWriter, key string, value *time.Time) {
-	if value != nil {
-		if !reflect.DeepEqual(*value, time.Time{}) {
-			w.Header().Add(key, value.UTC().Format(http.TimeFormat))
-		}
+func setTimeHeader(w http.ResponseWriter, key string, value time.Time) {
+	if !value.IsZero() {
+		w.Header().Add(key, value.UTC().Format(http.TimeFormat))
 	}
 }
 
-func determineHTTPStatus(obj *s3.GetObjectOutput) int {
-	if obj.ContentRange != nil && len(*obj.ContentRange) > 0 {
+func determineHTTPStatus(obj *ObjectInfo) int {
+	if len(obj.ContentRange) > 0 {
 		if !totalFileSizeEqualToContentRange(obj) {
 			return http.StatusPartialContent
 		}
@@ -231,11 +293,11 @@ func determineHTTPStatus(obj *s3.GetObjectOutput) int {
 	return http.StatusOK
 }
 
-func totalFileSizeEqualToContentRange(obj *s3.GetObjectOutput) bool {
+func totalFileSizeEqualToContentRange(obj *ObjectInfo) bool {
 	totalSizeIsEqualToContentRange := false
 
 	if totalSize, err := strconv.ParseInt(getFileSizeAsString(obj), 10, 64); err == nil { // nolint
-		if totalSize == (*obj.ContentLength) {
+		if totalSize == obj.Size {
 			totalSizeIsEqualToContentRange = true
 		}
 	}
@@ -244,8 +306,8 @@ func totalFileSizeEqualToContentRange(obj *s3.GetObjectOutput) bool {
 }
 
 // See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Range
-func getFileSizeAsString(obj *s3.GetObjectOutput) string {
-	s := strings.Split(*obj.ContentRange, "/")
+func getFileSizeAsString(obj *ObjectInfo) string {
+	s := strings.Split(obj.ContentRange, "/")
 	if len(s) > 1 {
 		return strings.TrimSpace(s[1])
 	}
@@ -0,0 +1,89 @@
+package s3
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestAwsS3PutStreaming(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleWrite}}},
+		Upload: config.Upload{MaxObjectSize: 8},
+	}
+
+	upload := func(body io.Reader, length int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/upload.txt", body)
+		req.ContentLength = length
+		rec := httptest.NewRecorder()
+
+		require.NoError(t, AwsS3Put(echo.New().NewContext(req, rec)))
+
+		return rec
+	}
+
+	rec := upload(strings.NewReader("12345678"), 8)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	b, err := os.ReadFile(filepath.Join(dir, "upload.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(b))
+
+	// refused up front when the length is known, and while streaming when not
+	rec = upload(strings.NewReader("123456789"), 9)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = upload(strings.NewReader("123456789"), -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), errCodeEntityTooLarge)
+
+	// a body cut short is the client's fault
+	rec = upload(io.MultiReader(strings.NewReader("1234"), iotest.ErrReader(io.ErrUnexpectedEOF)), -1)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	b, err = os.ReadFile(filepath.Join(dir, "upload.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(b))
+}
+
+func TestUploadMetadata(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead, config.RoleWrite}}},
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/report.csv", strings.NewReader("a,b"))
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Cache-Control", "max-age=60")
+	req.Header.Set("Content-Disposition", "attachment")
+	req.Header.Set("X-Amz-Meta-Owner", "alice")
+
+	require.NoError(t, AwsS3Put(echo.New().NewContext(req, httptest.NewRecorder())))
+
+	req = httptest.NewRequest(http.MethodGet, "/report.csv", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+	assert.Equal(t, "a,b", rec.Body.String())
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "attachment", rec.Header().Get("Content-Disposition"))
+	assert.Equal(t, "alice", rec.Header().Get("X-Amz-Meta-Owner"))
+}
@@ -0,0 +1,315 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// walkPageSize is how many keys are listed at a time when walking a prefix
+const walkPageSize = 1000
+
+// trashPurgeInterval is how often the trash is checked for expired objects
+var trashPurgeInterval = time.Hour
+
+// deleteResult answers a prefix delete like S3 answers a multi-object delete
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult" json:"-"`
+	Deleted []deletedObject `xml:"Deleted" json:"deleted"`
+	Errors  []deleteError   `xml:"Error" json:"errors"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key" json:"key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key" json:"key"`
+	Code    string `xml:"Code" json:"code"`
+	Message string `xml:"Message" json:"message"`
+}
+
+// trashPrefix returns the key prefix deleted objects are moved under, or ""
+// when deletes are final
+func trashPrefix() string {
+	p := config.Cfg.Delete.TrashPrefix
+	if p == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(cleanKey(p), "/") + "/"
+}
+
+// inTrash reports whether a key is the trash or is under it
+func inTrash(key string) bool {
+	trash := trashPrefix()
+
+	return trash != "" && strings.HasPrefix(key+"/", trash)
+}
+
+// AwsS3Delete handles delete requests. Objects are moved to the trash first
+// when there is one, unless a version is given, and a prefix is deleted
+// along with everything under it with ?recursive=true.
+func AwsS3Delete(e echo.Context) error {
+	req := e.Request()
+	res := e.Response()
+	key := cleanKey(req.URL.Path)
+	q := req.URL.Query()
+
+	if recursive, _ := strconv.ParseBool(q.Get("recursive")); recursive {
+		return deletePrefix(e, key)
+	}
+
+	// There is no object at the root to delete
+	if key == "" {
+		return writeErrorResponse(e, http.StatusBadRequest, errCodeInvalidArgument)
+	}
+
+	out, err := deleteKey(e, key, q.Get("versionId"))
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	setStrHeader(res, "x-amz-version-id", out.VersionID)
+
+	if out.DeleteMarker {
+		res.Header().Set("x-amz-delete-marker", "true")
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// deleteKey deletes an object from the write store, moving it to the trash
+// first if there is one, and drops the copies kept by the caches
+func deleteKey(e echo.Context, key, versionID string) (*DeleteResult, error) {
+	c := config.Cfg
+	ctx := e.Request().Context()
+	store := c.WriteStore()
+
+	trash := ""
+	if prefix := trashPrefix(); prefix != "" && versionID == "" {
+		trash = prefix + key
+
+		// A missing object has nothing to move, and deleting it succeeds like
+		// it does on S3
+		if err := storeFor(store).Copy(ctx, key, trash); err != nil && !isNotFound(err) {
+			return nil, err
+		}
+	}
+
+	out, err := del(ctx, store, &key, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	forgetDeleted(key)
+
+	for _, cache := range c.CacheStores() {
+		if cache == store {
+			continue
+		}
+
+		if _, err := del(ctx, cache, &key, ""); err != nil {
+			c.Logger.Warnf("unable to delete the copy of %s in %s: %v", key, cache.Name, err)
+		}
+	}
+
+	c.Logger.Infof("deleted %s from %s, version: %q, trash: %q, request: %s",
+		key, store.Name, versionID, trash, e.Response().Header().Get(echo.HeaderXRequestID))
+
+	return out, nil
+}
+
+// forgetDeleted drops what the proxy itself keeps of a deleted object
+func forgetDeleted(key string) {
+	objectCache.remove(key)
+	smallObjects.remove(key)
+	inflight.forgetKey(key)
+}
+
+// deletePrefix deletes every object under a prefix, answering with the keys
+// deleted and the ones that couldn't be
+func deletePrefix(e echo.Context, prefix string) error {
+	// Without a trailing slash, logs would take logs-old along with it
+	if prefix == "" || !strings.HasSuffix(prefix, "/") {
+		return writeErrorResponse(e, http.StatusBadRequest, errCodeInvalidArgument)
+	}
+
+	result := &deleteResult{Deleted: []deletedObject{}, Errors: []deleteError{}}
+
+	var batch []string
+
+	err := walk(e.Request().Context(), config.Cfg.WriteStore(), prefix, func(obj ObjectInfo) {
+		batch = append(batch, obj.Key)
+
+		if len(batch) == maxDeleteBatch {
+			deleteBatch(e, batch, result)
+			batch = nil
+		}
+	})
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	deleteBatch(e, batch, result)
+
+	return writeResult(e, http.StatusOK, result)
+}
+
+// deleteBatch deletes keys from the write store like deleteKey does, with a
+// single request on stores that take multi-object deletes
+func deleteBatch(e echo.Context, keys []string, result *deleteResult) {
+	c := config.Cfg
+	ctx := e.Request().Context()
+	store := c.WriteStore()
+
+	if len(keys) == 0 {
+		return
+	}
+
+	failed := func(key string, err error) {
+		_, code := toHTTPError(err)
+		result.Errors = append(result.Errors, deleteError{Key: key, Code: code, Message: errorMessage[code]})
+	}
+
+	// Objects are only deleted once they are safe in the trash
+	if prefix := trashPrefix(); prefix != "" {
+		moved := make([]string, 0, len(keys))
+
+		for _, key := range keys {
+			if err := storeFor(store).Copy(ctx, key, prefix+key); err != nil && !isNotFound(err) {
+				failed(key, err)
+
+				continue
+			}
+
+			moved = append(moved, key)
+		}
+
+		keys = moved
+	}
+
+	errs := delMany(ctx, store, keys)
+	deleted := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		if err, ok := errs[key]; ok {
+			failed(key, err)
+
+			continue
+		}
+
+		forgetDeleted(key)
+
+		deleted = append(deleted, key)
+		result.Deleted = append(result.Deleted, deletedObject{Key: key})
+	}
+
+	for _, cache := range c.CacheStores() {
+		if cache == store {
+			continue
+		}
+
+		for key, err := range delMany(ctx, cache, deleted) {
+			c.Logger.Warnf("unable to delete the copy of %s in %s: %v", key, cache.Name, err)
+		}
+	}
+
+	c.Logger.Infof("deleted %d objects from %s, trash: %q, request: %s",
+		len(deleted), store.Name, trashPrefix(), e.Response().Header().Get(echo.HeaderXRequestID))
+}
+
+// walk calls fn with every object under a prefix of a store, a page at a
+// time, leaving out the trash unless it is what is walked
+func walk(ctx context.Context, store *config.Bucket, prefix string, fn func(ObjectInfo)) error {
+	trash := trashPrefix()
+	skipTrash := trash != "" && !strings.HasPrefix(prefix, trash)
+	startAfter := ""
+
+	for {
+		page, err := listAll(ctx, store, prefix, startAfter, walkPageSize)
+		if err != nil {
+			return err
+		}
+
+		skipped := false
+
+		for _, obj := range page.Objects {
+			if skipTrash && inTrash(obj.Key) {
+				// Starting after the trash skips every key inside it
+				startAfter = trash + string(utf8.MaxRune)
+				skipped = true
+
+				break
+			}
+
+			startAfter = obj.Key
+
+			fn(obj)
+		}
+
+		if !skipped && (!page.IsTruncated || len(page.Objects) == 0) {
+			return nil
+		}
+	}
+}
+
+// StartTrashPurge removes objects from the trash once they are older than
+// the retention, until the context is done
+func StartTrashPurge(ctx context.Context) {
+	d := config.Cfg.Delete
+	if trashPrefix() == "" || d.TrashRetention <= 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(trashPurgeInterval)
+		defer t.Stop()
+
+		for {
+			purgeTrash(ctx, time.Now().Add(-d.TrashRetention))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// purgeTrash deletes the objects moved to the trash before the cutoff
+func purgeTrash(ctx context.Context, cutoff time.Time) {
+	c := config.Cfg
+	store := c.WriteStore()
+	purged := 0
+
+	err := walk(ctx, store, trashPrefix(), func(obj ObjectInfo) {
+		if !obj.LastModified.Before(cutoff) {
+			return
+		}
+
+		if _, err := del(ctx, store, &obj.Key, ""); err != nil {
+			c.Logger.Warnf("unable to purge %s from the trash: %v", obj.Key, err)
+
+			return
+		}
+
+		purged++
+	})
+	if err != nil {
+		c.Logger.Errorf("unable to purge the trash of %s: %v", store.Name, err)
+	}
+
+	if purged > 0 {
+		c.Logger.Infof("purged %d objects from the trash of %s", purged, store.Name)
+	}
+}
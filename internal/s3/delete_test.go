@@ -0,0 +1,136 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestDelete(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead, config.RoleWrite}}},
+		Delete: config.Delete{Enabled: true, TrashPrefix: "/.trash"},
+	}
+
+	for _, key := range []string{"a.txt", "logs/1.txt", "logs/old/2.txt", "logs-old/3.txt"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, key)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, key), []byte(key), 0o600))
+	}
+
+	exists := func(key string) bool {
+		_, err := os.Stat(filepath.Join(dir, key))
+
+		return err == nil
+	}
+
+	deleteReq := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, target, http.NoBody)
+		rec := httptest.NewRecorder()
+
+		require.NoError(t, Handler(AwsS3Delete)(echo.New().NewContext(req, rec)))
+
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNoContent, deleteReq("/a.txt").Code)
+	assert.False(t, exists("a.txt"))
+	assert.True(t, exists(".trash/a.txt"))
+
+	var walked []string
+
+	require.NoError(t, walk(context.Background(), config.Cfg.WriteStore(), "", func(obj ObjectInfo) {
+		walked = append(walked, obj.Key)
+	}))
+	assert.Equal(t, []string{"logs-old/3.txt", "logs/1.txt", "logs/old/2.txt"}, walked)
+
+	// the trash is out of reach, and versions are for versioned stores only
+	assert.Equal(t, http.StatusForbidden, deleteReq("/.trash/a.txt").Code)
+	assert.Equal(t, http.StatusBadRequest, deleteReq("/logs-old/3.txt?versionId=1").Code)
+	assert.Equal(t, http.StatusBadRequest, deleteReq("/logs?recursive=true").Code)
+	assert.Equal(t, http.StatusBadRequest, deleteReq("//").Code)
+
+	rec := deleteReq("/logs/?recursive=true")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Key>logs/old/2.txt</Key>")
+	assert.False(t, exists("logs"))
+	assert.True(t, exists("logs-old/3.txt"))
+	assert.True(t, exists(".trash/logs/old/2.txt"))
+
+	purgeTrash(context.Background(), time.Now().Add(time.Minute))
+	assert.False(t, exists(".trash"))
+}
+
+// batchDeleteStore deletes through the store it wraps, counting requests
+type batchDeleteStore struct {
+	Store
+	batches int
+}
+
+func (s *batchDeleteStore) DeleteObjects(ctx context.Context, keys []string) (map[string]error, error) {
+	s.batches++
+
+	failed := map[string]error{}
+
+	for _, key := range keys {
+		if _, err := s.Delete(ctx, key, ""); err != nil {
+			failed[key] = err
+		}
+	}
+
+	return failed, nil
+}
+
+func TestDeletePrefixInBatches(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead, config.RoleWrite}}},
+		Delete: config.Delete{Enabled: true},
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "logs"), 0o755))
+
+	for i := 0; i < maxDeleteBatch+1; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "logs", fmt.Sprint(i)), nil, 0o600))
+	}
+
+	bucket := config.Cfg.WriteStore()
+	store := &batchDeleteStore{Store: storeFor(bucket)}
+
+	storesMu.Lock()
+	stores[bucket] = store
+	storesMu.Unlock()
+
+	t.Cleanup(func() {
+		storesMu.Lock()
+		delete(stores, bucket)
+		storesMu.Unlock()
+	})
+
+	req := httptest.NewRequest(http.MethodDelete, "/logs/?recursive=true", http.NoBody)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, Handler(AwsS3Delete)(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 2, store.batches)
+	assert.Equal(t, maxDeleteBatch+1, strings.Count(rec.Body.String(), `"key"`))
+	assert.NoDirExists(t, filepath.Join(dir, "logs"))
+}
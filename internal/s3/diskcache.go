@@ -0,0 +1,540 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+)
+
+// EvictionPolicy decides which objects leave the disk cache first
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used objects first
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used objects first, the least
+	// recently used of those hit as often
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// Results of a disk cache lookup, as labeled on the disk cache counter
+const (
+	diskCacheHit   = "hit"
+	diskCacheMiss  = "miss"
+	diskCacheStale = "stale"
+)
+
+var (
+	// ErrUnknownEvictionPolicy is returned when a policy name isn't
+	// recognised
+	ErrUnknownEvictionPolicy = errors.New("unknown disk cache eviction policy")
+	// ErrDiskCacheDir is returned when the directory the disk cache keeps its
+	// objects in holds files it didn't put there
+	ErrDiskCacheDir = errors.New("disk cache directory isn't empty and wasn't made by the disk cache")
+)
+
+const (
+	// diskCacheSubdir is the directory the cache keeps everything in, under
+	// the configured one, which may well be shared
+	diskCacheSubdir = "aws-s3-proxy-cache"
+	// diskCacheMarker marks a directory as the cache's own, following the
+	// cache directory tagging spec so that backup tools skip it
+	diskCacheMarker = "CACHEDIR.TAG"
+	diskCacheTag    = "Signature: 8a477f597d28d172789f06886806bc55\n# This file is a cache directory tag created by aws-s3-proxy.\n"
+)
+
+// ParseEvictionPolicy maps a configured name onto an EvictionPolicy, an
+// empty name being the default of lru
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(name); p {
+	case "":
+		return EvictLRU, nil
+	case EvictLRU, EvictLFU:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnknownEvictionPolicy, name)
+}
+
+// InitDiskCache opens the configured disk cache, picking up the objects a
+// previous run left in it. The cache is off without a directory.
+func InitDiskCache() error {
+	dc := config.Cfg.DiskCache
+	if dc.Directory == "" {
+		return nil
+	}
+
+	policy, err := ParseEvictionPolicy(dc.Policy)
+	if err != nil {
+		return err
+	}
+
+	return objectCache.open(dc.Directory, dc.MaxSize, policy)
+}
+
+// diskCacheEntry describes a cached object, as kept next to it on disk
+type diskCacheEntry struct {
+	Info        ObjectInfo `json:"info"`
+	ValidatedAt time.Time  `json:"validatedAt"`
+
+	hits     int64
+	lastUsed time.Time
+}
+
+// diskCache keeps whole objects on local disk, filled from downloads as
+// they are streamed to clients, and evicts them by policy to stay within
+// its size. Everything is kept in a directory of its own, marked as such.
+// Objects and their descriptions are named after the hash of their key
+// under objects/, partial fills are kept under tmp/.
+type diskCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	policy  EvictionPolicy
+	size    int64
+	entries map[string]*diskCacheEntry
+	filling map[string]*cacheFill
+}
+
+var objectCache = &diskCache{}
+
+func (d *diskCache) open(dir string, maxSize int64, policy EvictionPolicy) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dir = filepath.Join(filepath.Clean(dir), diskCacheSubdir)
+	d.maxSize = maxSize
+	d.policy = policy
+	d.size = 0
+	d.entries = map[string]*diskCacheEntry{}
+	d.filling = map[string]*cacheFill{}
+
+	// Nothing is removed from a directory the cache didn't make
+	if err := claimCacheDir(d.dir); err != nil {
+		return err
+	}
+
+	// Partial fills of a previous run are of no use
+	if err := os.RemoveAll(d.tmpDir()); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(d.tmpDir(), 0o755); err != nil {
+		return err
+	}
+
+	err := filepath.WalkDir(filepath.Join(d.dir, "objects"), func(p string, de fs.DirEntry, err error) error {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case !de.IsDir() && filepath.Ext(p) == ".json":
+			d.load(p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.evict("")
+	metrics.DiskCacheBytes.Set(float64(d.size))
+
+	return nil
+}
+
+// claimCacheDir makes sure a directory is the cache's own, creating it
+// along with its marker if it is missing or empty
+func claimCacheDir(dir string) error {
+	marker := filepath.Join(dir, diskCacheMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case len(entries) > 0:
+		return fmt.Errorf("%w: %s", ErrDiskCacheDir, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(marker, []byte(diskCacheTag), 0o644)
+}
+
+// load picks up an object cached by a previous run, throwing it away if
+// its description doesn't match what is on disk
+func (d *diskCache) load(metaPath string) {
+	dataPath := metaPath[:len(metaPath)-len(".json")]
+
+	var (
+		entry diskCacheEntry
+		fi    os.FileInfo
+	)
+
+	b, err := os.ReadFile(metaPath)
+	if err == nil {
+		err = json.Unmarshal(b, &entry)
+	}
+
+	if err == nil {
+		fi, err = os.Stat(dataPath)
+	}
+
+	if data, _ := d.paths(entry.Info.Key); err != nil || data != dataPath || fi.Size() != entry.Info.Size {
+		os.Remove(metaPath)
+		os.Remove(dataPath)
+
+		return
+	}
+
+	entry.lastUsed = entry.ValidatedAt
+	d.entries[entry.Info.Key] = &entry
+	d.size += entry.Info.Size
+}
+
+func (d *diskCache) enabled() bool {
+	return d.dir != ""
+}
+
+func (d *diskCache) tmpDir() string {
+	return filepath.Join(d.dir, "tmp")
+}
+
+// paths returns where the object of a key and its description are kept
+func (d *diskCache) paths(key string) (data, meta string) {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	data = filepath.Join(d.dir, "objects", name[:2], name)
+
+	return data, data + ".json"
+}
+
+// lookup returns what is cached of a key along with its opened body,
+// counting it as used. The body is opened with the lock held, so that it
+// is the one described even if a new version is committed right after.
+func (d *diskCache) lookup(key string) (diskCacheEntry, *os.File, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entries[key]
+	if !ok {
+		return diskCacheEntry{}, nil, false
+	}
+
+	data, _ := d.paths(key)
+
+	// It was removed from under the cache
+	f, err := os.Open(data)
+	if err != nil {
+		d.drop(key)
+		metrics.DiskCacheBytes.Set(float64(d.size))
+
+		return diskCacheEntry{}, nil, false
+	}
+
+	entry.hits++
+	entry.lastUsed = time.Now()
+
+	return *entry, f, true
+}
+
+// claimRevalidation reports whether a cached object is due to be
+// revalidated, marking it as validated so that concurrent hits don't all
+// revalidate it at once
+func (d *diskCache) claimRevalidation(key string, after time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entries[key]
+	if !ok || time.Since(entry.ValidatedAt) < after {
+		return false
+	}
+
+	entry.ValidatedAt = time.Now()
+
+	return true
+}
+
+// remove drops a key from the cache, along with any fill of it under way,
+// as it has just been written
+func (d *diskCache) remove(key string) {
+	if !d.enabled() {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.filling, key)
+	d.drop(key)
+	metrics.DiskCacheBytes.Set(float64(d.size))
+}
+
+// drop deletes a cached object, with the lock held
+func (d *diskCache) drop(key string) {
+	entry, ok := d.entries[key]
+	if !ok {
+		return
+	}
+
+	data, meta := d.paths(key)
+	os.Remove(meta)
+	os.Remove(data)
+
+	delete(d.entries, key)
+	d.size -= entry.Info.Size
+}
+
+// evict drops objects by policy until the cache fits within its size,
+// sparing the one just added
+func (d *diskCache) evict(keep string) {
+	if d.size <= d.maxSize {
+		return
+	}
+
+	keys := make([]string, 0, len(d.entries))
+	for key := range d.entries {
+		if key != keep {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := d.entries[keys[i]], d.entries[keys[j]]
+		if d.policy == EvictLFU && a.hits != b.hits {
+			return a.hits < b.hits
+		}
+
+		return a.lastUsed.Before(b.lastUsed)
+	})
+
+	for _, key := range keys {
+		if d.size <= d.maxSize {
+			break
+		}
+
+		d.drop(key)
+		metrics.DiskCacheEvictionCounter.Inc()
+	}
+}
+
+// fill tees an object into the cache as its body is read, if it is whole,
+// of known size, has an ETag to revalidate it with, fits, and isn't
+// already being filled
+func (d *diskCache) fill(key string, obj *Object) {
+	if !d.enabled() || obj.ContentRange != "" || obj.ETag == "" || obj.Size < 0 || obj.Size > d.maxSize {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.filling[key]; ok {
+		return
+	}
+
+	f, err := os.CreateTemp(d.tmpDir(), "fill-*")
+	if err != nil {
+		config.Cfg.Logger.Warnf("unable to cache %s: %v", key, err)
+
+		return
+	}
+
+	t := &cacheFill{ReadCloser: obj.Body, cache: d, key: key, info: obj.ObjectInfo, f: f}
+	d.filling[key] = t
+	obj.Body = t
+}
+
+// finish commits a fill once the whole object has been read, unless the
+// key was written in the meantime
+func (d *diskCache) finish(t *cacheFill) {
+	err := t.err
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := d.filling[t.key] == t
+	if current {
+		delete(d.filling, t.key)
+	}
+
+	if err == nil && current && t.n == t.info.Size {
+		err = d.commit(t.key, t.info, t.f.Name())
+	}
+
+	if err != nil {
+		config.Cfg.Logger.Warnf("unable to cache %s: %v", t.key, err)
+	}
+
+	os.Remove(t.f.Name())
+}
+
+// commit moves a filled object into place, with the lock held
+func (d *diskCache) commit(key string, info ObjectInfo, tmp string) error {
+	d.drop(key)
+
+	now := time.Now()
+	entry := &diskCacheEntry{Info: info, ValidatedAt: now, lastUsed: now}
+	data, meta := d.paths(key)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(data), 0o755); err != nil {
+		return err
+	}
+
+	// The description goes first, so an object is never left without one
+	if err := os.WriteFile(meta, b, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, data); err != nil {
+		os.Remove(meta)
+
+		return err
+	}
+
+	d.entries[key] = entry
+	d.size += info.Size
+	d.evict(key)
+	metrics.DiskCacheBytes.Set(float64(d.size))
+
+	return nil
+}
+
+// cacheFill copies an object body into a temporary file as it is streamed
+// to the client
+type cacheFill struct {
+	io.ReadCloser
+	cache *diskCache
+	key   string
+	info  ObjectInfo
+	f     *os.File
+	n     int64
+	err   error
+}
+
+func (t *cacheFill) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	if n > 0 && t.err == nil {
+		_, t.err = t.f.Write(p[:n])
+		t.n += int64(n)
+	}
+
+	return n, err
+}
+
+func (t *cacheFill) Close() error {
+	err := t.ReadCloser.Close()
+	t.cache.finish(t)
+
+	return err
+}
+
+// revalidate checks a cached object's ETag against the stores, dropping it
+// if it changed or is gone. It is served as is while the stores can't be
+// asked.
+func (d *diskCache) revalidate(ctx context.Context, key string, entry *diskCacheEntry) bool {
+	info, _, err := readThrough(key, func(store *config.Bucket) (*ObjectInfo, error) {
+		return storeFor(store).Head(ctx, key, GetOptions{IfNoneMatch: entry.Info.ETag})
+	})
+
+	switch {
+	case statusOf(err) == http.StatusNotModified, err == nil && info.ETag == entry.Info.ETag:
+		return true
+	case err == nil, isNotFound(err):
+		d.remove(key)
+
+		return false
+	}
+
+	config.Cfg.Logger.Warnf("unable to revalidate %s, serving it from the disk cache: %v", key, err)
+
+	return true
+}
+
+func recordDiskCache(result string) {
+	metrics.DiskCacheCounter.WithLabelValues(result).Inc()
+}
+
+// serveCached answers a download from the disk cache if it holds the
+// object, revalidating it first when RevalidateAfter has passed. Ranges
+// and conditions are answered from the cached object. It reports whether
+// the request was answered.
+func serveCached(e echo.Context, key string) (bool, error) {
+	d := objectCache
+	if !d.enabled() {
+		return false, nil
+	}
+
+	req := e.Request()
+	key = cleanKey(key)
+
+	entry, f, ok := d.lookup(key)
+	if !ok {
+		recordDiskCache(diskCacheMiss)
+
+		return false, nil
+	}
+
+	if d.claimRevalidation(key, config.Cfg.DiskCache.RevalidateAfter) && !d.revalidate(req.Context(), key, &entry) {
+		f.Close()
+		recordDiskCache(diskCacheStale)
+
+		return false, nil
+	}
+
+	recordDiskCache(diskCacheHit)
+
+	obj := &Object{ObjectInfo: entry.Info, Body: f}
+	opts := getOptions(req.Header)
+
+	if !ifRangeMatches(&obj.ObjectInfo, req.Header.Get("If-Range")) {
+		opts.Range = ""
+	}
+
+	err := checkConditions(&obj.ObjectInfo, opts)
+	if err == nil {
+		err = sliceObject(obj, f, opts.Range)
+	}
+
+	if err != nil {
+		f.Close()
+
+		return true, writeError(e, err)
+	}
+
+	return true, writeObject(e, obj, determineHTTPStatus(&obj.ObjectInfo))
+}
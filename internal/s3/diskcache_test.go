@@ -0,0 +1,156 @@
+package s3
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fillCache(t *testing.T, d *diskCache, key, body string) {
+	t.Helper()
+
+	obj := &Object{
+		ObjectInfo: ObjectInfo{Key: key, Size: int64(len(body)), ETag: `"` + key + `"`},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+
+	d.fill(key, obj)
+
+	_, err := io.Copy(io.Discard, obj.Body)
+	require.NoError(t, err)
+	require.NoError(t, obj.Body.Close())
+}
+
+func cachedKeys(d *diskCache, keys ...string) []string {
+	var found []string
+
+	for _, key := range keys {
+		if _, ok := d.entries[key]; ok {
+			found = append(found, key)
+		}
+	}
+
+	return found
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	d := &diskCache{}
+	require.NoError(t, d.open(dir, 10, EvictLRU))
+
+	fillCache(t, d, "a", "aaaa")
+	fillCache(t, d, "b", "bbbb")
+
+	entry, f, ok := d.lookup("a")
+	require.True(t, ok)
+	assert.Equal(t, `"a"`, entry.Info.ETag)
+
+	// the body opened is the one described, even once replaced
+	fillCache(t, d, "a", "AAA")
+
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, "aaaa", string(b))
+	assert.Equal(t, int64(7), d.size)
+
+	fillCache(t, d, "a", "aaaa")
+
+	// b is the least recently used
+	fillCache(t, d, "c", "cccc")
+	assert.Equal(t, []string{"a", "c"}, cachedKeys(d, "a", "b", "c"))
+	assert.Equal(t, int64(8), d.size)
+
+	// what is on disk is picked up again
+	reopened := &diskCache{}
+	require.NoError(t, reopened.open(dir, 10, EvictLRU))
+	assert.Equal(t, []string{"a", "c"}, cachedKeys(reopened, "a", "b", "c"))
+
+	reopened.remove("a")
+	assert.Equal(t, []string{"c"}, cachedKeys(reopened, "a", "c"))
+}
+
+func TestDiskCacheLFU(t *testing.T) {
+	d := &diskCache{}
+	require.NoError(t, d.open(t.TempDir(), 10, EvictLFU))
+
+	fillCache(t, d, "a", "aaaa")
+	fillCache(t, d, "b", "bbbb")
+
+	for _, key := range []string{"a", "a", "b"} {
+		_, f, ok := d.lookup(key)
+		require.True(t, ok)
+		f.Close()
+	}
+
+	// b was used last, but less often
+	fillCache(t, d, "c", "cccc")
+	assert.Equal(t, []string{"a", "c"}, cachedKeys(d, "a", "b", "c"))
+}
+
+func TestDiskCacheIncompleteFill(t *testing.T) {
+	d := &diskCache{}
+	require.NoError(t, d.open(t.TempDir(), 10, EvictLRU))
+
+	// the client went away part way
+	obj := &Object{ObjectInfo: ObjectInfo{Size: 4, ETag: `"a"`}, Body: io.NopCloser(strings.NewReader("aaaa"))}
+	d.fill("a", obj)
+
+	_, err := obj.Body.Read(make([]byte, 2))
+	require.NoError(t, err)
+	require.NoError(t, obj.Body.Close())
+
+	// the key was written while it was read
+	obj = &Object{ObjectInfo: ObjectInfo{Size: 4, ETag: `"b"`}, Body: io.NopCloser(strings.NewReader("bbbb"))}
+	d.fill("b", obj)
+	d.remove("b")
+
+	_, err = io.Copy(io.Discard, obj.Body)
+	require.NoError(t, err)
+	require.NoError(t, obj.Body.Close())
+
+	// too large to ever fit
+	fillCache(t, d, "c", "ccccccccccc")
+
+	assert.Empty(t, d.entries)
+	assert.Empty(t, d.filling)
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	p, err := ParseEvictionPolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, EvictLRU, p)
+
+	p, err = ParseEvictionPolicy("lfu")
+	require.NoError(t, err)
+	assert.Equal(t, EvictLFU, p)
+
+	_, err = ParseEvictionPolicy("fifo")
+	assert.ErrorIs(t, err, ErrUnknownEvictionPolicy)
+}
+
+func TestDiskCacheDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// a directory the cache shares is left alone
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "tmp"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tmp", "keep"), nil, 0o600))
+
+	d := &diskCache{}
+	require.NoError(t, d.open(dir, 10, EvictLRU))
+	assert.FileExists(t, filepath.Join(dir, "tmp", "keep"))
+	assert.FileExists(t, filepath.Join(dir, diskCacheSubdir, diskCacheMarker))
+
+	// and so is one it didn't make
+	other := filepath.Join(t.TempDir(), diskCacheSubdir)
+	require.NoError(t, os.MkdirAll(other, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(other, "keep"), nil, 0o600))
+
+	assert.ErrorIs(t, d.open(filepath.Dir(other), 10, EvictLRU), ErrDiskCacheDir)
+	assert.FileExists(t, filepath.Join(other, "keep"))
+}
@@ -0,0 +1,654 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5" //nolint:gosec
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// fsMetaDir holds the sidecar metadata and temporary files of a filesystem
+// store under its root, out of the way of keys and listings
+const fsMetaDir = ".s3-proxy"
+
+// fsMeta is the sidecar of a file, only trusted while the file still has
+// the size and modification time it was recorded with
+type fsMeta struct {
+	ETag               string            `json:"etag"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	ContentType        string            `json:"contentType,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Size               int64             `json:"size"`
+	ModTime            time.Time         `json:"modTime"`
+}
+
+// fsStore is a Store keeping objects as files under a directory, with keys
+// under the bucket's prefix if it has one. Writes go to a temporary file
+// first and are renamed into place, so readers never see half an object.
+type fsStore struct {
+	bucket *config.Bucket
+	root   string
+}
+
+func newFSStore(bucket *config.Bucket) *fsStore {
+	return &fsStore{
+		bucket: bucket,
+		root:   filepath.Clean(bucket.Directory),
+	}
+}
+
+// path maps a key onto its file, refusing keys that can't be a file
+func (s *fsStore) path(key string) (string, bool) {
+	k := withPrefix(s.bucket, cleanKey(key))
+	if k == "" || strings.HasSuffix(k, "/") || k == fsMetaDir || strings.HasPrefix(k, fsMetaDir+"/") {
+		return "", false
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(k)), true
+}
+
+func (s *fsStore) metaPath(key string) string {
+	k := withPrefix(s.bucket, cleanKey(key))
+
+	return filepath.Join(s.root, fsMetaDir, "meta", filepath.FromSlash(k)+".json")
+}
+
+func (s *fsStore) tmpDir() string {
+	return filepath.Join(s.root, fsMetaDir, "tmp")
+}
+
+func (s *fsStore) Get(_ context.Context, key string, opts GetOptions) (*Object, error) {
+	p, ok := s.path(key)
+	if !ok {
+		return nil, fsNotFound(errCodeNoSuchKey, nil)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fsError(errCodeNoSuchKey, err)
+	}
+
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = fsNotFound(errCodeNoSuchKey, nil)
+	}
+
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	info := s.info(key, p, fi)
+
+	if err := checkConditions(info, opts); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	obj := &Object{ObjectInfo: *info, Body: f}
+
+	if err := sliceObject(obj, f, opts.Range); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (s *fsStore) Head(_ context.Context, key string, opts GetOptions) (*ObjectInfo, error) {
+	p, ok := s.path(key)
+	if !ok {
+		return nil, fsNotFound(errCodeNotFound, nil)
+	}
+
+	fi, err := os.Stat(p)
+	if err == nil && fi.IsDir() {
+		err = fsNotFound(errCodeNotFound, nil)
+	}
+
+	if err != nil {
+		return nil, fsError(errCodeNotFound, err)
+	}
+
+	info := s.info(key, p, fi)
+
+	if err := checkConditions(info, opts); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Put writes the body to a temporary file, hashing it on the way, then
+// renames it into place and records its sidecar
+func (s *fsStore) Put(_ context.Context, key string, body io.Reader, opts PutOptions) (*PutResult, error) {
+	p, ok := s.path(key)
+	if !ok {
+		return nil, &Error{Code: errCodeInvalidArgument, Status: http.StatusBadRequest, Err: fmt.Errorf("%w: %q", errInvalidKey, key)}
+	}
+
+	if err := os.MkdirAll(s.tmpDir(), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(s.tmpDir(), "put-*")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	h := md5.New() //nolint:gosec
+
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return nil, err
+	}
+
+	meta := &fsMeta{
+		ETag:               `"` + hex.EncodeToString(h.Sum(nil)) + `"`,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		ContentEncoding:    opts.ContentEncoding,
+		ContentLanguage:    opts.ContentLanguage,
+		ContentType:        opts.ContentType,
+		Metadata:           opts.Metadata,
+		Size:               n,
+		ModTime:            fi.ModTime(),
+	}
+
+	if err := s.writeMeta(key, meta); err != nil {
+		return nil, err
+	}
+
+	return &PutResult{ETag: meta.ETag}, nil
+}
+
+// Delete removes a file and its sidecar, then any directories left empty.
+// Like S3, deleting a missing key succeeds.
+func (s *fsStore) Delete(_ context.Context, key, versionID string) (*DeleteResult, error) {
+	if versionID != "" {
+		return nil, &Error{Code: errCodeInvalidArgument, Status: http.StatusBadRequest, Err: errNotVersioned}
+	}
+
+	p, ok := s.path(key)
+	if !ok {
+		return &DeleteResult{}, nil
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	meta := s.metaPath(key)
+	if err := os.Remove(meta); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	s.prune(filepath.Dir(p), s.root)
+	s.prune(filepath.Dir(meta), filepath.Join(s.root, fsMetaDir))
+
+	return &DeleteResult{}, nil
+}
+
+// prune removes empty directories from dir up to, but not including, stop
+func (s *fsStore) prune(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (s *fsStore) List(_ context.Context, prefix, startAfter string, maxKeys int) (*ListPage, error) {
+	dir, namePrefix := path.Split(withPrefix(s.bucket, prefix))
+
+	entries, err := os.ReadDir(filepath.Join(s.root, filepath.FromSlash(dir)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ListPage{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		key string
+		fs.DirEntry
+	}
+
+	var matches []entry
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if (dir == "" && name == fsMetaDir) || !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+
+		key := withoutPrefix(s.bucket, dir+name)
+
+		if e.IsDir() {
+			// S3 has no empty folders
+			if empty, err := isEmptyDir(filepath.Join(s.root, filepath.FromSlash(dir+name))); err != nil || empty {
+				continue
+			}
+
+			key += "/"
+		}
+
+		if startAfter != "" && key <= startAfter {
+			continue
+		}
+
+		matches = append(matches, entry{key, e})
+	}
+
+	// A folder sorts by its key with the trailing slash, as in S3
+	sort.Slice(matches, func(i, j int) bool { return matches[i].key < matches[j].key })
+
+	page := &ListPage{}
+
+	if maxKeys > 0 && len(matches) > maxKeys {
+		matches = matches[:maxKeys]
+		page.IsTruncated = true
+	}
+
+	for _, m := range matches {
+		if m.IsDir() {
+			page.Folders = append(page.Folders, m.key)
+
+			continue
+		}
+
+		fi, err := m.Info()
+		if err != nil {
+			continue
+		}
+
+		page.Objects = append(page.Objects, s.listed(m.key, fi))
+	}
+
+	return page, nil
+}
+
+func (s *fsStore) ListAll(_ context.Context, prefix, startAfter string, maxKeys int) (*ListPage, error) {
+	full := withPrefix(s.bucket, prefix)
+	dir, _ := path.Split(full)
+
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(filepath.Join(s.root, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			// Only folders holding the prefix or under it can have matches
+			if name == fsMetaDir || (name != "." && !strings.HasPrefix(name+"/", full) && !strings.HasPrefix(full, name+"/")) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		key := withoutPrefix(s.bucket, name)
+
+		if !strings.HasPrefix(name, full) || (startAfter != "" && key <= startAfter) {
+			return nil
+		}
+
+		if fi, err := d.Info(); err == nil {
+			objects = append(objects, s.listed(key, fi))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are walked a folder at a time, which isn't the order of their keys
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	page := &ListPage{}
+
+	if maxKeys > 0 && len(objects) > maxKeys {
+		objects = objects[:maxKeys]
+		page.IsTruncated = true
+	}
+
+	page.Objects = objects
+
+	return page, nil
+}
+
+// listed returns how a file is listed
+func (s *fsStore) listed(key string, fi os.FileInfo) ObjectInfo {
+	obj := ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime().UTC().Truncate(time.Second),
+	}
+
+	// Hashing every file would make listings slow, so only recorded ETags
+	// are listed
+	if meta := s.readMeta(key, fi); meta != nil {
+		obj.ETag = meta.ETag
+	}
+
+	return obj
+}
+
+func (s *fsStore) Copy(ctx context.Context, srcKey, dstKey string) error {
+	obj, err := s.Get(ctx, srcKey, GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer obj.Body.Close()
+
+	_, err = s.Put(ctx, dstKey, obj.Body, copyOptions(&obj.ObjectInfo))
+
+	return err
+}
+
+// info describes a file, from its sidecar when that is still current, and
+// otherwise by hashing it and guessing its type from its extension
+func (s *fsStore) info(key, p string, fi os.FileInfo) *ObjectInfo {
+	meta := s.readMeta(key, fi)
+	if meta == nil {
+		meta = &fsMeta{Size: fi.Size(), ModTime: fi.ModTime()}
+
+		if etag, err := hashFile(p); err == nil {
+			meta.ETag = etag
+
+			// best effort, so the next read doesn't hash it again
+			_ = s.writeMeta(key, meta)
+		}
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(p))
+	}
+
+	return &ObjectInfo{
+		Key:                key,
+		Size:               fi.Size(),
+		AcceptRanges:       "bytes",
+		CacheControl:       meta.CacheControl,
+		ContentDisposition: meta.ContentDisposition,
+		ContentEncoding:    meta.ContentEncoding,
+		ContentLanguage:    meta.ContentLanguage,
+		ContentType:        contentType,
+		ETag:               meta.ETag,
+		LastModified:       fi.ModTime().UTC().Truncate(time.Second),
+		Metadata:           meta.Metadata,
+	}
+}
+
+func (s *fsStore) readMeta(key string, fi os.FileInfo) *fsMeta {
+	b, err := os.ReadFile(s.metaPath(key))
+	if err != nil {
+		return nil
+	}
+
+	meta := &fsMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil
+	}
+
+	if meta.Size != fi.Size() || !meta.ModTime.Equal(fi.ModTime()) {
+		return nil
+	}
+
+	return meta
+}
+
+// writeMeta replaces a sidecar atomically
+func (s *fsStore) writeMeta(key string, meta *fsMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	p := s.metaPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.tmpDir(), "meta-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+var (
+	errInvalidKey   = errors.New("key can't be stored as a file")
+	errNotVersioned = errors.New("filesystem stores keep no versions")
+)
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := md5.New() //nolint:gosec
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// fsError turns a missing file into a not found error with the given code
+func fsError(code string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return fsNotFound(code, err)
+	}
+
+	return err
+}
+
+func fsNotFound(code string, err error) error {
+	return &Error{Code: code, Status: http.StatusNotFound, Err: err}
+}
+
+// checkConditions evaluates the conditions of a read the way S3 does:
+// If-Match wins over If-Unmodified-Since and If-None-Match over
+// If-Modified-Since
+func checkConditions(info *ObjectInfo, opts GetOptions) error {
+	if opts.IfMatch != "" {
+		if !etagMatches(opts.IfMatch, info.ETag) {
+			return &Error{Code: errCodePreconditionFailed, Status: http.StatusPreconditionFailed}
+		}
+	} else if !opts.IfUnmodifiedSince.IsZero() && info.LastModified.After(opts.IfUnmodifiedSince) {
+		return &Error{Code: errCodePreconditionFailed, Status: http.StatusPreconditionFailed}
+	}
+
+	if opts.IfNoneMatch != "" {
+		if etagMatches(opts.IfNoneMatch, info.ETag) {
+			return &Error{Code: errCodeNotModified, Status: http.StatusNotModified, Info: info}
+		}
+	} else if !opts.IfModifiedSince.IsZero() && !info.LastModified.After(opts.IfModifiedSince) {
+		return &Error{Code: errCodeNotModified, Status: http.StatusNotModified, Info: info}
+	}
+
+	return nil
+}
+
+// etagMatches reports whether an If-Match or If-None-Match list matches an
+// ETag, weakly as S3 does
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || (etag != "" && candidate == etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sliceObject narrows a whole object read from f down to the range asked
+// for, if any, answering it the way S3 would
+func sliceObject(obj *Object, f *os.File, spec string) error {
+	size := obj.Size
+
+	start, end, ok, err := parseRange(spec, size)
+	if err != nil || !ok {
+		return err
+	}
+
+	obj.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	obj.Size = end - start + 1
+	obj.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, start, obj.Size), f}
+
+	return nil
+}
+
+// parseRange reads a single byte range of an object of the given size.
+// Like S3, a range it can't read, or several ranges, mean the whole object,
+// and a range starting past the end can't be satisfied.
+func parseRange(spec string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(spec, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	unsatisfiable := &Error{Code: errCodeInvalidRange, Status: http.StatusRequestedRangeNotSatisfiable}
+
+	// a suffix of the last n bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+
+		if n == 0 || size == 0 {
+			return 0, 0, false, unsatisfiable
+		}
+
+		return max(size-n, 0), size - 1, true, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+
+	end = size - 1
+
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+	}
+
+	if start >= size {
+		return 0, 0, false, unsatisfiable
+	}
+
+	return start, min(end, size-1), true, nil
+}
@@ -0,0 +1,139 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestFSStore(t *testing.T) {
+	ctx := context.Background()
+	s := newFSStore(&config.Bucket{Directory: t.TempDir(), S3Prefix: "site"})
+
+	put, err := s.Put(ctx, "docs/a.txt", strings.NewReader("0123456789"), PutOptions{ContentType: "text/x-test"})
+	require.NoError(t, err)
+	assert.Equal(t, `"781e5e245d69b566979b86e28d23f2c7"`, put.ETag)
+
+	obj, err := s.Get(ctx, "docs/a.txt", GetOptions{Range: "bytes=2-4"})
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(obj.Body)
+	require.NoError(t, err)
+	obj.Body.Close()
+
+	assert.Equal(t, "234", string(b))
+	assert.Equal(t, "bytes 2-4/10", obj.ContentRange)
+	assert.Equal(t, int64(3), obj.Size)
+	assert.Equal(t, "text/x-test", obj.ContentType)
+	assert.Equal(t, put.ETag, obj.ETag)
+
+	_, err = s.Head(ctx, "docs/a.txt", GetOptions{IfNoneMatch: put.ETag})
+	assert.Equal(t, http.StatusNotModified, statusOf(err))
+
+	_, err = s.Head(ctx, "docs/a.txt", GetOptions{IfMatch: `"other"`})
+	assert.Equal(t, http.StatusPreconditionFailed, statusOf(err))
+
+	_, err = s.Get(ctx, "docs/a.txt", GetOptions{Range: "bytes=10-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, statusOf(err))
+
+	_, err = s.Get(ctx, "docs/missing.txt", GetOptions{})
+	assert.True(t, isNotFound(err))
+
+	_, err = s.Head(ctx, "docs", GetOptions{})
+	assert.True(t, isNotFound(err))
+
+	require.NoError(t, s.Copy(ctx, "docs/a.txt", "b.txt"))
+
+	page, err := s.List(ctx, "", "", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/"}, page.Folders)
+	require.Len(t, page.Objects, 1)
+	assert.Equal(t, "b.txt", page.Objects[0].Key)
+	assert.Equal(t, put.ETag, page.Objects[0].ETag)
+
+	page, err = s.List(ctx, "", "b.txt", 1)
+	require.NoError(t, err)
+	assert.False(t, page.IsTruncated)
+	assert.Equal(t, []string{"docs/"}, page.Folders)
+
+	_, err = s.Put(ctx, "docs-old.txt", strings.NewReader("old"), PutOptions{})
+	require.NoError(t, err)
+
+	// listing everything goes into folders and keeps to the order of keys
+	page, err = s.ListAll(ctx, "doc", "", 1000)
+	require.NoError(t, err)
+	assert.Empty(t, page.Folders)
+	require.Len(t, page.Objects, 2)
+	assert.Equal(t, "docs-old.txt", page.Objects[0].Key)
+	assert.Equal(t, "docs/a.txt", page.Objects[1].Key)
+
+	page, err = s.ListAll(ctx, "", "b.txt", 1)
+	require.NoError(t, err)
+	assert.True(t, page.IsTruncated)
+	require.Len(t, page.Objects, 1)
+	assert.Equal(t, "docs-old.txt", page.Objects[0].Key)
+
+	_, err = s.Delete(ctx, "docs/a.txt", "")
+	require.NoError(t, err)
+	_, err = s.Delete(ctx, "docs/a.txt", "")
+	require.NoError(t, err)
+
+	// the emptied folder goes with it
+	_, err = os.Stat(filepath.Join(s.root, "site", "docs"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFSStoreWithoutSidecar(t *testing.T) {
+	dir := t.TempDir()
+	s := newFSStore(&config.Bucket{Directory: dir})
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("0123456789"), 0o600))
+
+	info, err := s.Head(context.Background(), "index.html", GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, `"781e5e245d69b566979b86e28d23f2c7"`, info.ETag)
+	assert.Equal(t, "text/html; charset=utf-8", info.ContentType)
+
+	_, err = s.Head(context.Background(), fsMetaDir+"/tmp", GetOptions{})
+	assert.True(t, isNotFound(err))
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		spec       string
+		start, end int64
+		ok         bool
+		err        bool
+	}{
+		{"", 0, 0, false, false},
+		{"bytes=0-4", 0, 4, true, false},
+		{"bytes=5-", 5, 9, true, false},
+		{"bytes=-3", 7, 9, true, false},
+		{"bytes=-30", 0, 9, true, false},
+		{"bytes=8-20", 8, 9, true, false},
+		{"bytes=0-1,4-5", 0, 0, false, false},
+		{"bytes=4-2", 0, 0, false, false},
+		{"bytes=10-", 0, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		start, end, ok, err := parseRange(tt.spec, 10)
+
+		assert.Equal(t, tt.err, err != nil, tt.spec)
+		assert.Equal(t, tt.ok, ok, tt.spec)
+
+		if tt.ok {
+			assert.Equal(t, tt.start, start, tt.spec)
+			assert.Equal(t, tt.end, end, tt.spec)
+		}
+	}
+}
@@ -22,8 +22,13 @@ func Handler(handler echo.HandlerFunc) echo.HandlerFunc {
 			return nil
 		}
 
-		// With the fall back we don't want to list the dir.
-		if req.URL.Path == "/" {
+		// Deleted objects are only reachable in the store itself
+		if inTrash(cleanKey(req.URL.Path)) {
+			return writeErrorResponse(e, http.StatusForbidden, errCodeAccessDenied)
+		}
+
+		// Unless asked to, we don't want to list the dir, only serve its index.
+		if req.URL.Path == "/" && len(h.IndexDocuments) == 0 && !h.Listing {
 			res.WriteHeader(http.StatusNotFound)
 			return nil
 		}
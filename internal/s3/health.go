@@ -2,6 +2,7 @@ package s3
 
 import (
 	"net/http"
+	"sync/atomic"
 
 	"github.com/labstack/echo/v4"
 
@@ -24,3 +25,23 @@ func Health() echo.HandlerFunc {
 		return nil
 	})
 }
+
+// ready is whether the proxy takes traffic
+var ready atomic.Bool
+
+// SetReady sets whether readiness checks pass
+func SetReady(r bool) {
+	ready.Store(r)
+}
+
+// Ready returns a handler function that returns a HTTP 200 response while the
+// proxy takes traffic, and a 503 before it starts and once it shuts down
+func Ready() echo.HandlerFunc {
+	return echo.HandlerFunc(func(e echo.Context) error {
+		if !ready.Load() {
+			return e.NoContent(http.StatusServiceUnavailable)
+		}
+
+		return e.NoContent(http.StatusOK)
+	})
+}
@@ -0,0 +1,74 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// exists checks for a key in the read stores like a download would, so
+// keys recently missing from all of them aren't looked up again
+func exists(ctx context.Context, key string) bool {
+	if knownMissing(key) {
+		return false
+	}
+
+	_, _, err := readThrough(key, func(store *config.Bucket) (*ObjectInfo, error) {
+		return head(ctx, store, &key, nil)
+	})
+
+	return err == nil
+}
+
+// resolveIndex finds the first configured index document that exists under
+// a directory path ending in a slash
+func resolveIndex(ctx context.Context, dir string) (string, bool) {
+	for _, doc := range config.Cfg.HTTPOpts.IndexDocuments {
+		if doc == "" {
+			continue
+		}
+
+		if key := dir + doc; exists(ctx, key) {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// notFound answers for a key that isn't in any store. A directory path
+// without its trailing slash is redirected to the directory when it has an
+// index document, otherwise the custom not found document is served if set.
+func notFound(e echo.Context, key string) error {
+	c := config.Cfg
+	h := c.HTTPOpts
+	req := e.Request()
+
+	if h.RedirectToIndex && !strings.HasSuffix(key, "/") {
+		if _, ok := resolveIndex(req.Context(), key+"/"); ok {
+			// From the cleaned key, as a path like //host would otherwise be
+			// sent back as a protocol-relative URL to another site
+			u := url.URL{Path: "/" + cleanKey(key) + "/", RawQuery: req.URL.RawQuery}
+
+			return e.Redirect(http.StatusMovedPermanently, u.String())
+		}
+	}
+
+	if h.NotFoundDocument != "" && req.Method != http.MethodHead {
+		doc := "/" + strings.TrimPrefix(h.NotFoundDocument, "/")
+
+		obj, err := get(req.Context(), c.ReadStores()[0], &doc, nil)
+		if err == nil {
+			return writeObject(e, obj, http.StatusNotFound)
+		}
+
+		c.Logger.Warnf("unable to get not found document %s: %v", doc, err)
+	}
+
+	return writeErrorResponse(e, http.StatusNotFound, errCodeNoSuchKey)
+}
@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestRedirectToIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger:   zap.NewNop().Sugar(),
+		Stores:   []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead}}},
+		HTTPOpts: config.HTTPOpts{IndexDocuments: []string{"index.html"}, RedirectToIndex: true},
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "evil.example"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "evil.example", "index.html"), []byte("index"), 0o600))
+
+	for path, location := range map[string]string{
+		"/evil.example":   "/evil.example/?a=1",
+		"//evil.example":  "/evil.example/?a=1",
+		"/./evil.example": "/evil.example/?a=1",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?a=1", http.NoBody)
+		req.URL.Path = path
+		rec := httptest.NewRecorder()
+
+		require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+		assert.Equal(t, http.StatusMovedPermanently, rec.Code, path)
+		assert.Equal(t, location, rec.Header().Get("Location"), path)
+	}
+}
+
+func TestIndexLookups(t *testing.T) {
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{
+			{Name: "primary", Type: config.StoreTypeFilesystem, Directory: t.TempDir(), Roles: []string{config.RoleRead}},
+			{Name: "secondary", Type: config.StoreTypeFilesystem, Directory: t.TempDir(), Roles: []string{config.RoleRead}},
+		},
+		HTTPOpts:    config.HTTPOpts{IndexDocuments: []string{"index.html", "index.htm"}},
+		ReadThrough: config.ReadThrough{NegativeCacheTTL: time.Minute, NegativeCacheSize: 10},
+	}
+
+	t.Cleanup(func() {
+		missingKeys = &negativeCache{entries: map[string]time.Time{}}
+	})
+
+	var counted []*presigningStore
+
+	for _, bucket := range config.Cfg.ReadStores() {
+		bucket := bucket
+		store := &presigningStore{Store: storeFor(bucket)}
+		counted = append(counted, store)
+
+		storesMu.Lock()
+		stores[bucket] = store
+		storesMu.Unlock()
+
+		t.Cleanup(func() {
+			storesMu.Lock()
+			delete(stores, bucket)
+			storesMu.Unlock()
+		})
+	}
+
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/docs/", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+
+		return rec.Code
+	}
+
+	// missing index documents are remembered like missing downloads
+	assert.Equal(t, http.StatusNotFound, get())
+	assert.Equal(t, http.StatusNotFound, get())
+
+	for _, store := range counted {
+		assert.Equal(t, 2, store.heads)
+	}
+}
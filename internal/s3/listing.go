@@ -0,0 +1,245 @@
+package s3
+
+import (
+	"context"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+const (
+	maxListingKeys    = 1000
+	continuationParam = "continuation-token"
+	maxKeysParam      = "max-keys"
+)
+
+// listingEntry is a folder or an object in a directory listing
+type listingEntry struct {
+	Key          string     `json:"key"`
+	Name         string     `json:"name"`
+	Folder       bool       `json:"folder,omitempty"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+}
+
+// listing is one page of a directory listing
+type listing struct {
+	Prefix                string         `json:"prefix"`
+	Folders               []listingEntry `json:"folders"`
+	Objects               []listingEntry `json:"objects"`
+	IsTruncated           bool           `json:"isTruncated"`
+	NextContinuationToken string         `json:"nextContinuationToken,omitempty"`
+
+	// NextPage links to the next page with the query of this one
+	NextPage template.URL `json:"-"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{"href": listingHref}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of /{{.Prefix}}</title></head>
+<body>
+<h1>Index of /{{.Prefix}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last Modified</th><th>ETag</th></tr>
+{{- if .Prefix}}
+<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Folders}}
+<tr><td><a href="{{href .Name}}">{{.Name}}</a></td><td>-</td><td></td><td></td></tr>
+{{- end}}
+{{- range .Objects}}
+<tr><td><a href="{{href .Name}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{if .LastModified}}{{.LastModified.UTC.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.ETag}}</td></tr>
+{{- end}}
+</table>
+{{- if .IsTruncated}}
+<p><a href="{{.NextPage}}">Next page</a></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// listingHref links to an entry relative to its directory, escaping each
+// segment so names with a colon aren't taken for a scheme, or with ? or #
+// for a query or fragment
+func listingHref(name string) template.URL {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return template.URL("./" + strings.Join(segments, "/")) //nolint:gosec // every segment is escaped
+}
+
+// listDirectory answers a directory path with a listing of the objects and
+// folders under it, merged from every read store
+func listDirectory(e echo.Context, dir string) error {
+	req := e.Request()
+	q := req.URL.Query()
+
+	prefix := cleanKey(dir)
+
+	maxKeys := maxListingKeys
+	if candidate, err := strconv.Atoi(q.Get(maxKeysParam)); err == nil && candidate > 0 && candidate < maxKeys {
+		maxKeys = candidate
+	}
+
+	startAfter, err := decodeContinuationToken(q.Get(continuationParam))
+	if err != nil || (startAfter != "" && !strings.HasPrefix(startAfter, prefix)) {
+		return writeErrorResponse(e, http.StatusBadRequest, errCodeInvalidArgument)
+	}
+
+	l, err := listPage(req.Context(), prefix, startAfter, maxKeys)
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	// A directory is only there while something is in it
+	if prefix != "" && startAfter == "" && len(l.Folders) == 0 && len(l.Objects) == 0 {
+		return notFound(e, dir)
+	}
+
+	if strings.Contains(req.Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return e.JSON(http.StatusOK, l)
+	}
+
+	if l.IsTruncated {
+		q.Set(continuationParam, l.NextContinuationToken)
+		l.NextPage = template.URL("?" + q.Encode()) //nolint:gosec // the query is encoded
+	}
+
+	res := e.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+
+	return listingTemplate.Execute(res, l)
+}
+
+// listPage lists each store from the same starting key and merges the pages,
+// so that a single continuation token pages through all of them in order
+func listPage(ctx context.Context, prefix, startAfter string, maxKeys int) (*listing, error) {
+	c := config.Cfg
+
+	entries := map[string]listingEntry{}
+	truncated := false
+
+	for i, store := range c.ReadStores() {
+		out, err := list(ctx, store, prefix, startAfter, maxKeys)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+
+			c.Logger.Warnf("unable to list %s in %s, leaving it out: %v", prefix, store.Name, err)
+
+			continue
+		}
+
+		for _, key := range out.Folders {
+			if inTrash(key) {
+				continue
+			}
+
+			if _, ok := entries[key]; !ok {
+				entries[key] = listingEntry{
+					Key:    key,
+					Name:   strings.TrimPrefix(key, prefix),
+					Folder: true,
+				}
+			}
+		}
+
+		for _, obj := range out.Objects {
+			key := obj.Key
+
+			// skip the marker object some tools create for the folder itself
+			if key == prefix {
+				continue
+			}
+
+			if _, ok := entries[key]; !ok {
+				entries[key] = listingEntry{
+					Key:          key,
+					Name:         strings.TrimPrefix(key, prefix),
+					Size:         obj.Size,
+					LastModified: lastModified(obj.LastModified),
+					ETag:         strings.Trim(obj.ETag, `"`),
+				}
+			}
+		}
+
+		truncated = truncated || out.IsTruncated
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	// Every store returned all of its keys up to its last one, so the first
+	// maxKeys of the merged keys are complete
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		truncated = true
+	}
+
+	l := &listing{
+		Prefix:      prefix,
+		Folders:     []listingEntry{},
+		Objects:     []listingEntry{},
+		IsTruncated: truncated && len(keys) > 0,
+	}
+
+	for _, key := range keys {
+		entry := entries[key]
+		if entry.Folder {
+			l.Folders = append(l.Folders, entry)
+		} else {
+			l.Objects = append(l.Objects, entry)
+		}
+	}
+
+	if l.IsTruncated {
+		last := entries[keys[len(keys)-1]]
+		next := last.Key
+
+		// Starting after a folder must skip every key inside it too
+		if last.Folder {
+			next += string(utf8.MaxRune)
+		}
+
+		l.NextContinuationToken = encodeContinuationToken(next)
+	}
+
+	return l, nil
+}
+
+func lastModified(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func encodeContinuationToken(startAfter string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(startAfter))
+}
+
+func decodeContinuationToken(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+
+	return string(b), err
+}
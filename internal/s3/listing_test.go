@@ -0,0 +1,51 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestListingLinks(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger:   zap.NewNop().Sugar(),
+		Stores:   []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead}}},
+		HTTPOpts: config.HTTPOpts{Listing: true},
+	}
+
+	for _, key := range []string{"c:d.txt", "what?.txt", "tag#1/a.txt", "50% off.txt"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, key)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, key), []byte(key), 0o600))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `href="./c:d.txt"`)
+	assert.Contains(t, body, `href="./what%3F.txt"`)
+	assert.Contains(t, body, `href="./tag%231/"`)
+	assert.Contains(t, body, `href="./50%25%20off.txt"`)
+	assert.NotContains(t, body, "ZgotmplZ")
+
+	// the next page keeps the page size
+	req = httptest.NewRequest(http.MethodGet, "/?max-keys=2", http.NoBody)
+	rec = httptest.NewRecorder()
+
+	require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+	assert.Contains(t, rec.Body.String(), `href="?continuation-token=`+encodeContinuationToken("c:d.txt")+`&amp;max-keys=2"`)
+}
@@ -0,0 +1,261 @@
+package s3
+
+import (
+	"bytes"
+	lrulist "container/list"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+)
+
+// Results of a memory cache lookup, as labeled on the memory cache counter
+const (
+	memoryCacheHit  = "hit"
+	memoryCacheMiss = "miss"
+)
+
+// memKey identifies a cached response: the store it was read from, the key
+// and the range asked for
+type memKey struct {
+	store string
+	key   string
+	rng   string
+}
+
+type memEntry struct {
+	id      memKey
+	info    ObjectInfo
+	body    []byte
+	expires time.Time
+}
+
+// memoryCache keeps small objects in memory for as long as their
+// Cache-Control allows, evicting the least recently used once its byte
+// budget is spent
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int64
+	lru     *lrulist.List
+	entries map[memKey]*lrulist.Element
+	keys    map[string]map[memKey]struct{}
+}
+
+var smallObjects = newMemoryCache()
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{
+		lru:     lrulist.New(),
+		entries: map[memKey]*lrulist.Element{},
+		keys:    map[string]map[memKey]struct{}{},
+	}
+}
+
+// get returns a cached response unless it has expired
+func (m *memoryCache) get(id memKey) (*memEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*memEntry)
+	if time.Now().After(entry.expires) {
+		m.drop(el)
+
+		return nil, false
+	}
+
+	m.lru.MoveToFront(el)
+
+	return entry, true
+}
+
+// add caches a response for ttl, making room within maxSize by evicting the
+// least recently used ones
+func (m *memoryCache) add(entry *memEntry, ttl time.Duration, maxSize int64) {
+	if ttl <= 0 || int64(len(entry.body)) > maxSize {
+		return
+	}
+
+	entry.expires = time.Now().Add(ttl)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[entry.id]; ok {
+		m.drop(el)
+	}
+
+	m.entries[entry.id] = m.lru.PushFront(entry)
+	m.size += int64(len(entry.body))
+
+	if m.keys[entry.id.key] == nil {
+		m.keys[entry.id.key] = map[memKey]struct{}{}
+	}
+
+	m.keys[entry.id.key][entry.id] = struct{}{}
+
+	for m.size > maxSize {
+		m.drop(m.lru.Back())
+	}
+
+	metrics.MemoryCacheBytes.Set(float64(m.size))
+}
+
+// remove forgets every cached response of a key, as it has just been
+// written
+func (m *memoryCache) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id := range m.keys[key] {
+		m.drop(m.entries[id])
+	}
+
+	metrics.MemoryCacheBytes.Set(float64(m.size))
+}
+
+// drop deletes a cached response, with the lock held
+func (m *memoryCache) drop(el *lrulist.Element) {
+	entry := m.lru.Remove(el).(*memEntry)
+
+	delete(m.entries, entry.id)
+	delete(m.keys[entry.id.key], entry.id)
+
+	if len(m.keys[entry.id.key]) == 0 {
+		delete(m.keys, entry.id.key)
+	}
+
+	m.size -= int64(len(entry.body))
+}
+
+// memoryTTL is how long a response may be kept, from the Cache-Control sent
+// to clients with it. s-maxage wins over max-age, and responses without
+// either are kept for DefaultTTL.
+func memoryTTL(info *ObjectInfo) time.Duration {
+	c := config.Cfg
+
+	cc := c.HTTPOpts.HTTPCacheControl
+	if cc == "" {
+		cc = info.CacheControl
+	}
+
+	maxAge, sharedMaxAge := -1, -1
+
+	for _, directive := range strings.Split(cc, ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age":
+			maxAge = atoiOr(value, 0)
+		case "s-maxage":
+			sharedMaxAge = atoiOr(value, 0)
+		}
+	}
+
+	switch {
+	case sharedMaxAge >= 0:
+		return time.Duration(sharedMaxAge) * time.Second
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second
+	}
+
+	return c.MemoryCache.DefaultTTL
+}
+
+func atoiOr(s string, fallback int) int {
+	if n, err := strconv.Atoi(strings.Trim(s, `"`)); err == nil {
+		return n
+	}
+
+	return fallback
+}
+
+// memoryCacheable reports whether a download may be answered from, or
+// kept in, the memory cache. If-Range requests aren't, as whether they get
+// the range depends on the object.
+func memoryCacheable(e echo.Context) bool {
+	return config.Cfg.MemoryCache.MaxSize > 0 && e.Request().Header.Get("If-Range") == ""
+}
+
+// serveFromMemory answers a download from the memory cache if it holds the
+// response, as read from any of the read stores. It reports whether the
+// request was answered.
+func serveFromMemory(e echo.Context, key string) (bool, error) {
+	if !memoryCacheable(e) {
+		return false, nil
+	}
+
+	req := e.Request()
+
+	for _, store := range config.Cfg.ReadStores() {
+		entry, ok := smallObjects.get(memKey{store: store.Name, key: cleanKey(key), rng: req.Header.Get("Range")})
+		if !ok {
+			continue
+		}
+
+		metrics.MemoryCacheCounter.WithLabelValues(memoryCacheHit).Inc()
+
+		info := entry.info
+		if err := checkConditions(&info, getOptions(req.Header)); err != nil {
+			return true, writeError(e, err)
+		}
+
+		obj := &Object{ObjectInfo: info, Body: io.NopCloser(bytes.NewReader(entry.body))}
+
+		return true, writeObject(e, obj, determineHTTPStatus(&info))
+	}
+
+	metrics.MemoryCacheCounter.WithLabelValues(memoryCacheMiss).Inc()
+
+	return false, nil
+}
+
+// keepInMemory reads a small object read from a store into the memory
+// cache, leaving it ready to be sent from there
+func keepInMemory(e echo.Context, store *config.Bucket, key string, obj *Object) error {
+	mc := config.Cfg.MemoryCache
+
+	if !memoryCacheable(e) || obj.Size < 0 || obj.Size > mc.MaxObjectSize {
+		return nil
+	}
+
+	ttl := memoryTTL(&obj.ObjectInfo)
+	if ttl <= 0 {
+		return nil
+	}
+
+	// Read on to EOF, as bodies wrapped to copy the object elsewhere only
+	// know it is complete once they get there
+	body, err := io.ReadAll(io.LimitReader(obj.Body, obj.Size+1))
+	obj.Body.Close()
+
+	if err == nil && int64(len(body)) != obj.Size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return err
+	}
+
+	obj.Body = io.NopCloser(bytes.NewReader(body))
+
+	smallObjects.add(&memEntry{
+		id:   memKey{store: store.Name, key: cleanKey(key), rng: e.Request().Header.Get("Range")},
+		info: obj.ObjectInfo,
+		body: body,
+	}, ttl, mc.MaxSize)
+
+	return nil
+}
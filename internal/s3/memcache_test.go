@@ -0,0 +1,120 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestMemoryTTL(t *testing.T) {
+	config.Cfg = &config.Config{MemoryCache: config.MemoryCache{DefaultTTL: time.Minute}}
+
+	tests := []struct {
+		override     string
+		cacheControl string
+		ttl          time.Duration
+	}{
+		{"", "", time.Minute},
+		{"", "public, max-age=30", 30 * time.Second},
+		{"", "max-age=30, s-maxage=5", 5 * time.Second},
+		{"", "max-age=0", 0},
+		{"", "no-cache", 0},
+		{"", "Private, max-age=30", 0},
+		{"max-age=10", "max-age=30", 10 * time.Second},
+		{"no-store", "max-age=30", 0},
+	}
+
+	for _, tt := range tests {
+		config.Cfg.HTTPOpts.HTTPCacheControl = tt.override
+		assert.Equal(t, tt.ttl, memoryTTL(&ObjectInfo{CacheControl: tt.cacheControl}), tt.cacheControl)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	m := newMemoryCache()
+
+	a := memKey{store: "primary", key: "a"}
+	aRange := memKey{store: "primary", key: "a", rng: "bytes=0-1"}
+	b := memKey{store: "primary", key: "b"}
+
+	m.add(&memEntry{id: a, body: []byte("aaaa")}, time.Minute, 10)
+	m.add(&memEntry{id: aRange, body: []byte("aa")}, time.Minute, 10)
+	m.add(&memEntry{id: b, body: []byte("bbbbbbbbbbb")}, time.Minute, 10)
+
+	// too large for the budget
+	_, ok := m.get(b)
+	assert.False(t, ok)
+
+	// a range is cached on its own
+	_, ok = m.get(a)
+	assert.True(t, ok)
+
+	// the least recently used make room
+	m.add(&memEntry{id: b, body: []byte("bbbbbb")}, time.Minute, 10)
+
+	_, ok = m.get(aRange)
+	assert.False(t, ok)
+	assert.Equal(t, int64(10), m.size)
+
+	// uploads drop every response of a key
+	m.remove("a")
+
+	_, ok = m.get(a)
+	assert.False(t, ok)
+	assert.Equal(t, int64(6), m.size)
+
+	m.add(&memEntry{id: a, body: []byte("aaaa")}, time.Nanosecond, 10)
+	time.Sleep(time.Millisecond)
+
+	_, ok = m.get(a)
+	assert.False(t, ok)
+	assert.Equal(t, int64(6), m.size)
+}
+
+func TestKeepInMemoryWithBackfill(t *testing.T) {
+	cache, origin := t.TempDir(), t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{
+			{Name: "cache", Type: config.StoreTypeFilesystem, Directory: cache, Roles: []string{config.RoleRead, config.RoleCache}},
+			{Name: "origin", Type: config.StoreTypeFilesystem, Directory: origin, Roles: []string{config.RoleRead}},
+		},
+		ReadThrough: config.ReadThrough{SpoolDir: t.TempDir(), BackfillQueueSize: 4, BackfillTimeout: time.Minute},
+		MemoryCache: config.MemoryCache{MaxSize: 1 << 10, MaxObjectSize: 1 << 10, DefaultTTL: time.Minute},
+	}
+
+	previous := backfills
+	backfills = &backfiller{}
+
+	t.Cleanup(func() {
+		backfills = previous
+		smallObjects = newMemoryCache()
+	})
+
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "small.txt"), []byte("payload"), 0o600))
+
+	req := httptest.NewRequest(http.MethodGet, "/small.txt", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+	assert.Equal(t, "payload", rec.Body.String())
+
+	// the file store never answers EOF along with the last bytes, which the
+	// memory cache reading them doesn't take for a short read
+	assert.Eventually(t, func() bool {
+		got, err := os.ReadFile(filepath.Join(cache, "small.txt"))
+
+		return err == nil && string(got) == "payload"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+const (
+	// maxPartNumber is the last part number S3 takes in an upload
+	maxPartNumber = 10000
+	// maxListParts is the most parts listed at a time, and the default
+	maxListParts = 1000
+	// maxCompleteBodySize bounds the part list sent to complete an upload,
+	// which is well under 1MB with every part
+	maxCompleteBodySize = 2 << 20
+)
+
+// multipartHandler handles a request of the multipart upload protocol
+type multipartHandler func(e echo.Context, store MultipartStore, key, uploadID string) error
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult" json:"-"`
+	Key      string   `xml:"Key" json:"key"`
+	UploadID string   `xml:"UploadId" json:"uploadId"`
+}
+
+type completeMultipartUploadRequest struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int32  `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult" json:"-"`
+	Key     string   `xml:"Key" json:"key"`
+	ETag    string   `xml:"ETag" json:"etag"`
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name     `xml:"ListPartsResult" json:"-"`
+	Key                  string       `xml:"Key" json:"key"`
+	UploadID             string       `xml:"UploadId" json:"uploadId"`
+	PartNumberMarker     int32        `xml:"PartNumberMarker" json:"partNumberMarker"`
+	NextPartNumberMarker int32        `xml:"NextPartNumberMarker" json:"nextPartNumberMarker"`
+	MaxParts             int32        `xml:"MaxParts" json:"maxParts"`
+	IsTruncated          bool         `xml:"IsTruncated" json:"isTruncated"`
+	Parts                []listedPart `xml:"Part" json:"parts"`
+}
+
+type listedPart struct {
+	PartNumber   int32     `xml:"PartNumber" json:"partNumber"`
+	LastModified time.Time `xml:"LastModified" json:"lastModified"`
+	ETag         string    `xml:"ETag" json:"etag"`
+	Size         int64     `xml:"Size" json:"size"`
+}
+
+// MultipartUploads takes the requests of the S3 multipart upload protocol,
+// told apart from other requests by their query, to the write store. It is
+// a middleware as some of them, like listing parts with a GET, share their
+// route with other requests.
+func MultipartUploads(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		handler := multipartHandlerFor(e.Request())
+		if handler == nil {
+			return next(e)
+		}
+
+		return Handler(func(e echo.Context) error {
+			req := e.Request()
+
+			defer req.Body.Close()
+
+			key := cleanKey(req.URL.Path)
+			if key == "" {
+				return writeErrorResponse(e, http.StatusBadRequest, errCodeInvalidArgument)
+			}
+
+			store, ok := storeFor(config.Cfg.WriteStore()).(MultipartStore)
+			if !ok {
+				return writeErrorResponse(e, http.StatusNotImplemented, errCodeNotImplemented)
+			}
+
+			return handler(e, store, key, req.URL.Query().Get("uploadId"))
+		})(e)
+	}
+}
+
+// multipartHandlerFor returns the handler of a multipart upload request, or
+// nil for other requests
+func multipartHandlerFor(req *http.Request) multipartHandler {
+	q := req.URL.Query()
+
+	switch {
+	case req.Method == http.MethodPost && q.Has("uploads"):
+		return createMultipartUpload
+	case !q.Has("uploadId"):
+		return nil
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		return uploadPart
+	case http.MethodPost:
+		return completeMultipartUpload
+	case http.MethodDelete:
+		return abortMultipartUpload
+	case http.MethodGet:
+		return listParts
+	}
+
+	return nil
+}
+
+// createMultipartUpload starts an upload with the metadata of the request
+// and the store's upload settings for the key
+func createMultipartUpload(e echo.Context, store MultipartStore, key, _ string) error {
+	req := e.Request()
+	opts := withUploadSettings(config.Cfg.WriteStore(), key, uploadOptions(req.Header))
+
+	uploadID, err := store.CreateMultipartUpload(req.Context(), key, opts)
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	return writeResult(e, http.StatusOK, &initiateMultipartUploadResult{Key: key, UploadID: uploadID})
+}
+
+// uploadPart streams a part to the store. Its length has to be known up
+// front, as it is for S3.
+func uploadPart(e echo.Context, store MultipartStore, key, uploadID string) error {
+	req := e.Request()
+	res := e.Response()
+
+	partNumber, err := strconv.ParseInt(req.URL.Query().Get("partNumber"), 10, 32)
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		return writeErrorResponse(e, http.StatusBadRequest, errCodeInvalidArgument)
+	}
+
+	switch {
+	case req.Header.Get("x-amz-copy-source") != "":
+		return writeErrorResponse(e, http.StatusNotImplemented, errCodeNotImplemented)
+	case req.ContentLength < 0:
+		return writeErrorResponse(e, http.StatusLengthRequired, errCodeMissingLength)
+	case config.Cfg.Upload.MaxObjectSize > 0 && req.ContentLength > config.Cfg.Upload.MaxObjectSize:
+		return writeErrorResponse(e, http.StatusRequestEntityTooLarge, errCodeEntityTooLarge)
+	}
+
+	etag, err := store.UploadPart(req.Context(), key, uploadID, int32(partNumber), uploadBody{r: req.Body}, req.ContentLength)
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	setStrHeader(res, "ETag", etag)
+
+	return e.NoContent(http.StatusOK)
+}
+
+// completeMultipartUpload makes the object from the parts listed in the
+// request, once they are known to fit the size limit
+func completeMultipartUpload(e echo.Context, store MultipartStore, key, uploadID string) error {
+	c := config.Cfg
+	req := e.Request()
+	res := e.Response()
+
+	var body completeMultipartUploadRequest
+	if err := xml.NewDecoder(io.LimitReader(req.Body, maxCompleteBodySize)).Decode(&body); err != nil || len(body.Parts) == 0 {
+		return writeErrorResponse(e, http.StatusBadRequest, errCodeMalformedXML)
+	}
+
+	parts := make([]Part, 0, len(body.Parts))
+	for _, p := range body.Parts {
+		parts = append(parts, Part{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+
+	if limit := c.Upload.MaxObjectSize; limit > 0 {
+		size, err := uploadSize(req.Context(), store, key, uploadID, parts)
+		if err != nil {
+			return writeError(e, err)
+		}
+
+		// Nothing can be made of the parts anymore
+		if size > limit {
+			if err := store.AbortMultipartUpload(req.Context(), key, uploadID); err != nil {
+				c.Logger.Warnf("unable to abort the upload %s of %s: %v", uploadID, key, err)
+			}
+
+			return writeErrorResponse(e, http.StatusRequestEntityTooLarge, errCodeEntityTooLarge)
+		}
+	}
+
+	put, err := store.CompleteMultipartUpload(req.Context(), key, uploadID, parts)
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	missingKeys.remove(key)
+	objectCache.remove(key)
+	smallObjects.remove(key)
+	inflight.forgetKey(key)
+
+	setStrHeader(res, "x-amz-version-id", put.VersionID)
+
+	return writeResult(e, http.StatusOK, &completeMultipartUploadResult{Key: key, ETag: put.ETag})
+}
+
+// uploadSize adds up the sizes of the given parts of an upload
+func uploadSize(ctx context.Context, store MultipartStore, key, uploadID string, parts []Part) (int64, error) {
+	sizes := map[int32]int64{}
+	marker := int32(0)
+
+	for {
+		page, err := store.ListParts(ctx, key, uploadID, marker, maxListParts)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, p := range page.Parts {
+			sizes[p.PartNumber] = p.Size
+		}
+
+		if !page.IsTruncated || page.NextPartNumberMarker <= marker {
+			break
+		}
+
+		marker = page.NextPartNumberMarker
+	}
+
+	var size int64
+	for _, p := range parts {
+		size += sizes[p.PartNumber]
+	}
+
+	return size, nil
+}
+
+func abortMultipartUpload(e echo.Context, store MultipartStore, key, uploadID string) error {
+	if err := store.AbortMultipartUpload(e.Request().Context(), key, uploadID); err != nil {
+		return writeError(e, err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// listParts lists the parts of an upload a page at a time, with the
+// max-parts and part-number-marker of S3
+func listParts(e echo.Context, store MultipartStore, key, uploadID string) error {
+	q := e.Request().URL.Query()
+
+	maxParts := int32(maxListParts)
+	if v, err := strconv.ParseInt(q.Get("max-parts"), 10, 32); err == nil && v > 0 && v < maxListParts {
+		maxParts = int32(v)
+	}
+
+	marker := int32(0)
+	if v, err := strconv.ParseInt(q.Get("part-number-marker"), 10, 32); err == nil && v > 0 {
+		marker = int32(v)
+	}
+
+	page, err := store.ListParts(e.Request().Context(), key, uploadID, marker, maxParts)
+	if err != nil {
+		return writeError(e, err)
+	}
+
+	result := &listPartsResult{
+		Key:                  key,
+		UploadID:             uploadID,
+		PartNumberMarker:     marker,
+		NextPartNumberMarker: page.NextPartNumberMarker,
+		MaxParts:             maxParts,
+		IsTruncated:          page.IsTruncated,
+		Parts:                []listedPart{},
+	}
+
+	for _, p := range page.Parts {
+		result.Parts = append(result.Parts, listedPart{PartNumber: p.PartNumber, LastModified: p.LastModified, ETag: p.ETag, Size: p.Size})
+	}
+
+	return writeResult(e, http.StatusOK, result)
+}
@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// memMultipartStore keeps the parts of its single upload in memory, writing
+// the object to the store it wraps once completed
+type memMultipartStore struct {
+	Store
+	parts map[int32][]byte
+}
+
+func (s *memMultipartStore) CreateMultipartUpload(context.Context, string, PutOptions) (string, error) {
+	s.parts = map[int32][]byte{}
+
+	return "1", nil
+}
+
+func (s *memMultipartStore) UploadPart(_ context.Context, _, _ string, partNumber int32, body io.Reader, _ int64) (string, error) {
+	b, err := io.ReadAll(body)
+	s.parts[partNumber] = b
+
+	return fmt.Sprintf("%q", fmt.Sprint(partNumber)), err
+}
+
+func (s *memMultipartStore) CompleteMultipartUpload(ctx context.Context, key, _ string, parts []Part) (*PutResult, error) {
+	var b bytes.Buffer
+	for _, p := range parts {
+		b.Write(s.parts[p.PartNumber])
+	}
+
+	return s.Put(ctx, key, &b, PutOptions{})
+}
+
+func (s *memMultipartStore) AbortMultipartUpload(context.Context, string, string) error {
+	s.parts = nil
+
+	return nil
+}
+
+func (s *memMultipartStore) ListParts(_ context.Context, _, _ string, marker, _ int32) (*PartsPage, error) {
+	page := &PartsPage{}
+
+	for n := marker + 1; int(n) <= len(s.parts); n++ {
+		page.Parts = append(page.Parts, Part{PartNumber: n, Size: int64(len(s.parts[n]))})
+	}
+
+	return page, nil
+}
+
+func TestMultipartUploads(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleWrite}}},
+		Upload: config.Upload{MaxObjectSize: 8},
+	}
+
+	next := func(e echo.Context) error {
+		return e.NoContent(http.StatusTeapot)
+	}
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+
+		require.NoError(t, MultipartUploads(next)(echo.New().NewContext(req, rec)))
+
+		return rec
+	}
+
+	// filesystem stores have no multipart uploads, and other requests pass
+	assert.Equal(t, http.StatusNotImplemented, send(http.MethodPost, "/image?uploads", "").Code)
+	assert.Equal(t, http.StatusTeapot, send(http.MethodGet, "/image?versionId=1", "").Code)
+
+	bucket := config.Cfg.WriteStore()
+	store := &memMultipartStore{Store: storeFor(bucket)}
+
+	storesMu.Lock()
+	stores[bucket] = store
+	storesMu.Unlock()
+
+	t.Cleanup(func() {
+		storesMu.Lock()
+		delete(stores, bucket)
+		storesMu.Unlock()
+	})
+
+	rec := send(http.MethodPost, "/image?uploads", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<UploadId>1</UploadId>")
+
+	rec = send(http.MethodPut, "/image?partNumber=1&uploadId=1", "1234")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/image?partNumber=2&uploadId=1", "56").Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, "/image?partNumber=10001&uploadId=1", "7").Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(http.MethodPut, "/image?partNumber=3&uploadId=1", "123456789").Code)
+
+	rec = send(http.MethodGet, "/image?uploadId=1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<PartNumber>2</PartNumber>")
+
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/image?uploadId=1", "<Complete").Code)
+
+	rec = send(http.MethodPost, "/image?uploadId=1",
+		"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber></Part><Part><PartNumber>2</PartNumber></Part></CompleteMultipartUpload>")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	b, err := os.ReadFile(filepath.Join(dir, "image"))
+	require.NoError(t, err)
+	assert.Equal(t, "123456", string(b))
+
+	// the limit holds for the whole object, the upload being dropped past it
+	send(http.MethodPost, "/other?uploads", "")
+	send(http.MethodPut, "/other?partNumber=1&uploadId=1", "12345")
+	send(http.MethodPut, "/other?partNumber=2&uploadId=1", "6789")
+
+	rec = send(http.MethodPost, "/other?uploadId=1",
+		"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber></Part><Part><PartNumber>2</PartNumber></Part></CompleteMultipartUpload>")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Nil(t, store.parts)
+
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/image?uploadId=1", "").Code)
+}
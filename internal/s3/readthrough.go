@@ -0,0 +1,219 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+)
+
+// FallbackPolicy decides which store errors are read through to the next
+// store
+type FallbackPolicy string
+
+const (
+	// FallbackNotFound only reads through objects missing from the primary
+	FallbackNotFound FallbackPolicy = "not-found"
+	// FallbackNotFoundAndServerError also reads through when the primary fails
+	FallbackNotFoundAndServerError FallbackPolicy = "not-found-and-5xx"
+	// FallbackAll reads through on any error from the primary
+	FallbackAll FallbackPolicy = "all"
+)
+
+// Outcomes of a read-through, as labeled on the outcome counter
+const (
+	outcomeHit              = "hit"
+	outcomeNotFound         = "not_found"
+	outcomeError            = "error"
+	outcomeSkipped          = "skipped"
+	outcomeNegativeCacheHit = "negative_cache_hit"
+)
+
+// ErrUnknownFallbackPolicy is returned when a policy name isn't recognised
+var ErrUnknownFallbackPolicy = errors.New("unknown read-through fallback policy")
+
+// ParseFallbackPolicy maps a configured name onto a FallbackPolicy, an empty
+// name being the default of not-found
+func ParseFallbackPolicy(name string) (FallbackPolicy, error) {
+	switch p := FallbackPolicy(name); p {
+	case "":
+		return FallbackNotFound, nil
+	case FallbackNotFound, FallbackNotFoundAndServerError, FallbackAll:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnknownFallbackPolicy, name)
+}
+
+// shouldReadThrough decides if a store error is worth asking the next store
+// about
+func shouldReadThrough(err error) bool {
+	status, _ := toHTTPError(err)
+
+	// The client is gone, or the object is there but didn't meet its conditions
+	if _, ok := conditionalStatus(err); ok || status == statusClientClosedRequest {
+		return false
+	}
+
+	policy, _ := ParseFallbackPolicy(config.Cfg.ReadThrough.FallbackPolicy)
+
+	switch policy {
+	case FallbackAll:
+		return true
+	case FallbackNotFoundAndServerError:
+		return isNotFound(err) || status >= http.StatusInternalServerError
+	}
+
+	return isNotFound(err)
+}
+
+func recordOutcome(store *config.Bucket, outcome string) {
+	metrics.SecondaryStoreOutcomeCounter.WithLabelValues(store.Name, outcome).Inc()
+}
+
+// readThrough tries each read store in order with read, moving on to the
+// next store for as long as the fallback policy allows. It returns what the
+// first successful store answered along with its position, or the last
+// error. A key missing from every store is remembered in the negative cache.
+func readThrough[T any](key string, read func(store *config.Bucket) (T, error)) (T, int, error) {
+	c := config.Cfg
+	rt := c.ReadThrough
+	stores := c.ReadStores()
+
+	var (
+		out     T
+		err     error
+		missing = true
+	)
+
+	for i, store := range stores {
+		if i > 0 {
+			// Increment the echo_secondary_store_read_through_total counter
+			metrics.SecondaryStoreCounter.Inc()
+		}
+
+		out, err = read(store)
+		if err == nil {
+			if i > 0 {
+				recordOutcome(store, outcomeHit)
+			}
+
+			return out, i, nil
+		}
+
+		missing = missing && isNotFound(err)
+
+		_, conditional := conditionalStatus(err)
+
+		if i > 0 {
+			switch {
+			case conditional:
+				recordOutcome(store, outcomeHit)
+			case isNotFound(err):
+				recordOutcome(store, outcomeNotFound)
+			default:
+				recordOutcome(store, outcomeError)
+			}
+		}
+
+		if i == len(stores)-1 {
+			break
+		}
+
+		if !shouldReadThrough(err) {
+			if !conditional {
+				recordOutcome(store, outcomeSkipped)
+			}
+
+			return out, -1, err
+		}
+
+		c.Logger.Debugf("unable to read %s from %s, trying %s: %v", key, store.Name, stores[i+1].Name, err)
+	}
+
+	if missing && len(stores) > 1 {
+		missingKeys.add(cleanKey(key), rt.NegativeCacheTTL, rt.NegativeCacheSize)
+	}
+
+	return out, -1, err
+}
+
+// knownMissing reports whether a key was recently missing from every read
+// store, so it isn't worth asking any of them again
+func knownMissing(key string) bool {
+	stores := config.Cfg.ReadStores()
+	if len(stores) < 2 || !missingKeys.contains(cleanKey(key)) {
+		return false
+	}
+
+	recordOutcome(stores[0], outcomeNegativeCacheHit)
+
+	return true
+}
+
+// negativeCache remembers keys that are in no store for a while, so repeated
+// misses don't keep costing requests to all of them
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+var missingKeys = &negativeCache{entries: map[string]time.Time{}}
+
+// add remembers a missing key for ttl, making room by dropping expired
+// entries, then arbitrary ones, once size keys are held
+func (n *negativeCache) add(key string, ttl time.Duration, size int) {
+	if ttl <= 0 || size <= 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+
+	if len(n.entries) >= size {
+		for k, expires := range n.entries {
+			if now.After(expires) {
+				delete(n.entries, k)
+			}
+		}
+	}
+
+	for k := range n.entries {
+		if len(n.entries) < size {
+			break
+		}
+
+		delete(n.entries, k)
+	}
+
+	n.entries[key] = now.Add(ttl)
+}
+
+// contains reports whether a key is known to be missing
+func (n *negativeCache) contains(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expires, ok := n.entries[key]
+	if ok && time.Now().After(expires) {
+		delete(n.entries, key)
+
+		return false
+	}
+
+	return ok
+}
+
+// remove forgets a key, as it has just been written
+func (n *negativeCache) remove(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.entries, key)
+}
@@ -0,0 +1,61 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestShouldReadThrough(t *testing.T) {
+	config.Cfg = &config.Config{}
+
+	notFound := &Error{Code: errCodeNoSuchKey, Status: http.StatusNotFound}
+	denied := &Error{Code: errCodeAccessDenied, Status: http.StatusForbidden}
+	slowDown := &Error{Code: errCodeSlowDown, Status: http.StatusServiceUnavailable}
+	notModified := &Error{Code: errCodeNotModified, Status: http.StatusNotModified}
+	canceled := &Error{Code: errCodeRequestError, Err: context.Canceled}
+
+	tests := []struct {
+		policy   FallbackPolicy
+		expected map[error]bool
+	}{
+		{"", map[error]bool{notFound: true, denied: false, slowDown: false, notModified: false, canceled: false}},
+		{FallbackNotFoundAndServerError, map[error]bool{notFound: true, denied: false, slowDown: true, notModified: false, canceled: false}},
+		{FallbackAll, map[error]bool{notFound: true, denied: true, slowDown: true, notModified: false, canceled: false}},
+	}
+
+	for _, tt := range tests {
+		config.Cfg.ReadThrough.FallbackPolicy = string(tt.policy)
+
+		for err, expected := range tt.expected {
+			assert.Equal(t, expected, shouldReadThrough(err), "%s: %v", tt.policy, err)
+		}
+	}
+
+	_, err := ParseFallbackPolicy("sometimes")
+	assert.ErrorIs(t, err, ErrUnknownFallbackPolicy)
+}
+
+func TestNegativeCache(t *testing.T) {
+	n := &negativeCache{entries: map[string]time.Time{}}
+
+	n.add("disabled", 0, 10)
+	assert.False(t, n.contains("disabled"))
+
+	n.add("a", time.Minute, 2)
+	n.add("b", time.Minute, 2)
+	n.add("c", time.Minute, 2)
+	assert.Len(t, n.entries, 2)
+	assert.True(t, n.contains("c"))
+
+	n.remove("c")
+	assert.False(t, n.contains("c"))
+
+	n.entries["expired"] = time.Now().Add(-time.Second)
+	assert.False(t, n.contains("expired"))
+}
@@ -0,0 +1,98 @@
+package s3
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+	metrics "github.com/packethost/aws-s3-proxy/internal/metrics"
+)
+
+// redirect answers a download with a redirect to a presigned URL of the
+// store holding the object, when redirects apply to it, so the body doesn't
+// go through the proxy. The object is looked up with a HEAD, which gives its
+// size for the minimum. It reports whether it answered the request.
+func redirect(e echo.Context, key string) (bool, error) {
+	r := config.Cfg.Redirect
+	req := e.Request()
+
+	if !r.Matches(cleanKey(key)) {
+		return false, nil
+	}
+
+	// Conditions and ranges are left to the store, as clients send them
+	// again when following the redirect, and the size is of the whole object
+	info, i, err := readThrough(key, func(store *config.Bucket) (*ObjectInfo, error) {
+		return head(req.Context(), store, &key, nil)
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return true, notFound(e, key)
+		}
+
+		return true, writeError(e, err)
+	}
+
+	if info.Size < r.MinSize {
+		return false, nil
+	}
+
+	return sendRedirect(e, key, i)
+}
+
+// sendRedirect redirects to a presigned URL of the i-th read store, unless
+// it can't presign
+func sendRedirect(e echo.Context, key string, i int) (bool, error) {
+	c := config.Cfg
+	r := c.Redirect
+	store := c.ReadStores()[i]
+
+	presigner, ok := storeFor(store).(PresignStore)
+	if !ok {
+		return false, nil
+	}
+
+	url, err := presigner.PresignGet(e.Request().Context(), cleanKey(key), r.Expiry, presignOptions())
+	if err != nil {
+		return true, writeError(e, err)
+	}
+
+	metrics.RedirectCounter.WithLabelValues(store.Name).Inc()
+
+	// The URL expires, and is only for clients allowed to read the object
+	e.Response().Header().Set("Cache-Control", "no-store")
+
+	return true, e.Redirect(r.Status, url)
+}
+
+// presignOptions returns the headers S3 is to answer redirected downloads
+// with, falling back on the overrides of proxied downloads
+func presignOptions() PresignOptions {
+	h := config.Cfg.HTTPOpts
+	headers := config.Cfg.Redirect.ResponseHeaders()
+
+	opts := PresignOptions{
+		CacheControl:       h.HTTPCacheControl,
+		ContentDisposition: headers["Content-Disposition"],
+		ContentEncoding:    headers["Content-Encoding"],
+		ContentLanguage:    headers["Content-Language"],
+		ContentType:        headers["Content-Type"],
+	}
+
+	if v, ok := headers["Cache-Control"]; ok {
+		opts.CacheControl = v
+	}
+
+	expires := h.HTTPExpires
+	if v, ok := headers["Expires"]; ok {
+		expires = v
+	}
+
+	// S3 only takes a date, unlike the Expires of proxied downloads
+	if t, err := http.ParseTime(expires); err == nil {
+		opts.Expires = t
+	}
+
+	return opts
+}
@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// presigningStore hands out URLs made of the key and options of a store it
+// wraps, counting the HEADs and GETs it is sent
+type presigningStore struct {
+	Store
+	heads, gets int
+}
+
+func (s *presigningStore) Get(ctx context.Context, key string, opts GetOptions) (*Object, error) {
+	s.gets++
+
+	return s.Store.Get(ctx, key, opts)
+}
+
+func (s *presigningStore) Head(ctx context.Context, key string, opts GetOptions) (*ObjectInfo, error) {
+	s.heads++
+
+	return s.Store.Head(ctx, key, opts)
+}
+
+func (s *presigningStore) PresignGet(_ context.Context, key string, expiry time.Duration, opts PresignOptions) (string, error) {
+	return "https://store.example/" + key + "?expiry=" + expiry.String() + "&disposition=" + opts.ContentDisposition, nil
+}
+
+func TestRedirect(t *testing.T) {
+	dir := t.TempDir()
+
+	config.Cfg = &config.Config{
+		Logger: zap.NewNop().Sugar(),
+		Stores: []config.Bucket{{Name: "fs", Type: config.StoreTypeFilesystem, Directory: dir, Roles: []string{config.RoleRead}}},
+		Redirect: config.Redirect{
+			Prefixes: []string{"/images/"},
+			MinSize:  4,
+			Expiry:   time.Minute,
+			Status:   http.StatusTemporaryRedirect,
+			Headers:  []string{"Content-Disposition=attachment"},
+		},
+	}
+
+	for key, body := range map[string]string{"images/big.raw": "12345678", "images/small.raw": "1", "docs/big.txt": "12345678"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, key)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, key), []byte(body), 0o600))
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, http.NoBody)
+		rec := httptest.NewRecorder()
+
+		require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+
+		return rec
+	}
+
+	// stores that can't presign serve the object themselves
+	assert.Equal(t, http.StatusOK, get("/images/big.raw").Code)
+
+	bucket := config.Cfg.ReadStores()[0]
+	store := &presigningStore{Store: storeFor(bucket)}
+
+	storesMu.Lock()
+	stores[bucket] = store
+	storesMu.Unlock()
+
+	t.Cleanup(func() {
+		storesMu.Lock()
+		delete(stores, bucket)
+		storesMu.Unlock()
+	})
+
+	rec := get("/images/big.raw")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://store.example/images/big.raw?expiry=1m0s&disposition=attachment", rec.Header().Get("Location"))
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	// ranges are redirected by the size of the whole object
+	req := httptest.NewRequest(http.MethodGet, "/images/big.raw", http.NoBody)
+	req.Header.Set("Range", "bytes=0-1")
+	rec = httptest.NewRecorder()
+	require.NoError(t, AwsS3Get(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+
+	assert.Equal(t, http.StatusOK, get("/images/small.raw").Code)
+	assert.Equal(t, http.StatusOK, get("/docs/big.txt").Code)
+	assert.Equal(t, http.StatusNotFound, get("/images/missing.raw").Code)
+
+	// the size comes from a HEAD, and redirected objects are never read
+	assert.Equal(t, 4, store.heads)
+	assert.Equal(t, 2, store.gets)
+
+	config.Cfg.Redirect.MinSize = 0
+
+	assert.Equal(t, http.StatusTemporaryRedirect, get("/images/small.raw").Code)
+	assert.Equal(t, http.StatusNotFound, get("/images/missing.raw").Code)
+	assert.Equal(t, http.StatusOK, get("/docs/big.txt").Code)
+	assert.Equal(t, 6, store.heads)
+	assert.Equal(t, 3, store.gets)
+}
@@ -3,56 +3,141 @@ package s3
 import (
 	"context"
 	"io"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"net/http"
+	"path"
+	"strings"
 
 	"github.com/packethost/aws-s3-proxy/internal/config"
 )
 
-// Download wraps the  AWS s3 Get object
-type Download struct {
-	Output *s3.GetObjectOutput
+// cleanKey turns a request path into a bucket key. `..` and repeated slashes
+// are resolved first, so a key can never climb above the root.
+func cleanKey(p string) string {
+	key := strings.TrimPrefix(path.Clean("/"+p), "/")
+
+	if strings.HasSuffix(p, "/") && key != "" {
+		key += "/"
+	}
+
+	return key
 }
 
-// Upload wraps the s3 upload object
-type Upload struct {
-	Output *s3manager.UploadOutput
+// objectKey maps a request path onto its key in a bucket, under the bucket
+// prefix if there is one
+func objectKey(bucket *config.Bucket, p string) string {
+	return withPrefix(bucket, cleanKey(p))
+}
+
+func withPrefix(bucket *config.Bucket, key string) string {
+	if prefix := strings.Trim(bucket.S3Prefix, "/"); prefix != "" {
+		return prefix + "/" + key
+	}
+
+	return key
 }
 
-// Get returns a specified object from Amazon S3
-func get(ctx context.Context, bucket *config.Bucket, key, rangeHeader *string) (*Download, error) {
-	if bucket.Session == nil {
-		config.Cfg.Logger.Panic("bad s3 client")
+func withoutPrefix(bucket *config.Bucket, key string) string {
+	if prefix := strings.Trim(bucket.S3Prefix, "/"); prefix != "" {
+		return strings.TrimPrefix(key, prefix+"/")
 	}
 
-	req := &s3.GetObjectInput{
-		Bucket: &bucket.Bucket,
-		Key:    key,
-		Range:  rangeHeader,
+	return key
+}
+
+// get returns an object from a store, honouring the range and conditional
+// headers of the client request if given
+func get(ctx context.Context, bucket *config.Bucket, key *string, header http.Header) (*Object, error) {
+	opts := getOptions(header)
+
+	// without the range, in case the If-Range validator doesn't match
+	full := opts
+	full.Range = ""
+
+	s := storeFor(bucket)
+
+	if setIfRange(&opts, header) {
+		obj, err := s.Get(ctx, cleanKey(*key), opts)
+		if statusOf(err) != http.StatusPreconditionFailed {
+			return obj, err
+		}
+
+		opts = full
 	}
 
-	c := s3.New(bucket.Session)
-	get, err := c.GetObjectWithContext(ctx, req)
+	return s.Get(ctx, cleanKey(*key), opts)
+}
+
+// head returns the metadata of an object from a store without its body,
+// honouring the conditional headers of the client request if given
+func head(ctx context.Context, bucket *config.Bucket, key *string, header http.Header) (*ObjectInfo, error) {
+	return storeFor(bucket).Head(ctx, cleanKey(*key), getOptions(header))
+}
+
+// list returns a page of the objects and folders of a store directly under
+// a prefix, starting after the given key
+func list(ctx context.Context, bucket *config.Bucket, prefix, startAfter string, maxKeys int) (*ListPage, error) {
+	return storeFor(bucket).List(ctx, prefix, startAfter, maxKeys)
+}
+
+// listAll returns a page of every object of a store under a prefix,
+// starting after the given key
+func listAll(ctx context.Context, bucket *config.Bucket, prefix, startAfter string, maxKeys int) (*ListPage, error) {
+	return storeFor(bucket).ListAll(ctx, prefix, startAfter, maxKeys)
+}
 
-	return &Download{
-		Output: get,
-	}, err
+// del removes an object, or one version of it, from a store
+func del(ctx context.Context, bucket *config.Bucket, key *string, versionID string) (*DeleteResult, error) {
+	return storeFor(bucket).Delete(ctx, cleanKey(*key), versionID)
 }
 
-// Put uploads a file to the bucket
-func put(ctx context.Context, bucket *config.Bucket, key *string, r io.Reader) (*Upload, error) {
-	up := &s3manager.UploadInput{
-		Bucket: &bucket.Bucket,
-		ACL:    aws.String("public-read"),
-		Key:    key,
-		Body:   r,
+// delMany removes objects from a store, in batches where the store takes
+// them, returning the error of each object that couldn't be
+func delMany(ctx context.Context, bucket *config.Bucket, keys []string) map[string]error {
+	store := storeFor(bucket)
+	failed := map[string]error{}
+
+	batcher, ok := store.(BatchDeleteStore)
+	if !ok {
+		for _, key := range keys {
+			if _, err := store.Delete(ctx, cleanKey(key), ""); err != nil {
+				failed[key] = err
+			}
+		}
+
+		return failed
+	}
+
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), maxDeleteBatch)]
+		keys = keys[len(batch):]
+
+		errs, err := batcher.DeleteObjects(ctx, batch)
+
+		for _, key := range batch {
+			switch {
+			case err != nil:
+				failed[key] = err
+			case errs[key] != nil:
+				failed[key] = errs[key]
+			}
+		}
 	}
 
-	put, err := s3manager.NewUploader(bucket.Session).UploadWithContext(ctx, up)
+	return failed
+}
+
+// put uploads an object to a store, with the store's upload settings for
+// its key
+func put(ctx context.Context, bucket *config.Bucket, key *string, r io.Reader, opts PutOptions) (*PutResult, error) {
+	k := cleanKey(*key)
+
+	return storeFor(bucket).Put(ctx, k, r, withUploadSettings(bucket, k, opts))
+}
+
+// withUploadSettings applies the store's upload settings for a key
+func withUploadSettings(bucket *config.Bucket, key string, opts PutOptions) PutOptions {
+	u := bucket.UploadSettingsFor(key)
+	opts.ACL, opts.StorageClass, opts.SSE, opts.SSEKMSKeyID = u.ACL, u.StorageClass, u.SSE, u.SSEKMSKeyID
 
-	return &Upload{
-		Output: put,
-	}, err
+	return opts
 }
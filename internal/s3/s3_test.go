@@ -0,0 +1,40 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestObjectKey(t *testing.T) {
+	prefixed := &config.Bucket{S3Prefix: "/staging/"}
+	plain := &config.Bucket{}
+
+	tests := []struct {
+		path     string
+		plain    string
+		prefixed string
+	}{
+		{"/", "", "staging/"},
+		{"/a.txt", "a.txt", "staging/a.txt"},
+		{"/docs/", "docs/", "staging/docs/"},
+		{"//docs//a.txt", "docs/a.txt", "staging/docs/a.txt"},
+		{"/../production/secret", "production/secret", "staging/production/secret"},
+		{"/docs/../../a.txt", "a.txt", "staging/a.txt"},
+		{"/docs/./sub/../", "docs/", "staging/docs/"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.plain, objectKey(plain, tt.path), tt.path)
+		assert.Equal(t, tt.prefixed, objectKey(prefixed, tt.path), tt.path)
+	}
+}
+
+func TestWithoutPrefix(t *testing.T) {
+	b := &config.Bucket{S3Prefix: "staging"}
+
+	assert.Equal(t, "docs/a.txt", withoutPrefix(b, withPrefix(b, "docs/a.txt")))
+	assert.Equal(t, "docs/a.txt", withoutPrefix(&config.Bucket{}, "docs/a.txt"))
+}
@@ -0,0 +1,598 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// MinUploadPartSize is the smallest part S3 accepts in a multipart upload
+const MinUploadPartSize = manager.MinUploadPartSize
+
+// abortTimeout bounds aborting a failed multipart upload
+const abortTimeout = 30 * time.Second
+
+// maxCopyObjectSize is the largest object S3 copies in a single request
+const maxCopyObjectSize = 5 << 30
+
+// copyPartSize is the size of the parts larger objects are copied in, grown
+// for objects that would take more than the parts S3 allows
+const copyPartSize = 512 << 20
+
+// s3Store is a Store backed by an S3 bucket, with keys under the bucket's
+// prefix if it has one
+type s3Store struct {
+	bucket   *config.Bucket
+	client   *s3.Client
+	uploader *manager.Uploader
+}
+
+func newS3Store(bucket *config.Bucket) *s3Store {
+	client := s3.NewFromConfig(bucket.AWSConfig, func(o *s3.Options) {
+		if bucket.Endpoint != "" {
+			o.BaseEndpoint = aws.String(endpointURL(bucket))
+			o.UsePathStyle = true
+		}
+	})
+
+	return &s3Store{
+		bucket: bucket,
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			if c := config.Cfg; c != nil {
+				u.PartSize = c.Upload.PartSize
+				u.Concurrency = c.Upload.Concurrency
+			}
+
+			// Parts are aborted by Put, which the uploader would do with the
+			// request's context, cancelled if the client hung up
+			u.LeavePartsOnError = true
+		}),
+	}
+}
+
+// endpointURL makes a hostname only endpoint into a URL, over plain HTTP if
+// bucket TLS is disabled
+func endpointURL(bucket *config.Bucket) string {
+	if strings.Contains(bucket.Endpoint, "://") {
+		return bucket.Endpoint
+	}
+
+	if bucket.DisableBucketSSL {
+		return "http://" + bucket.Endpoint
+	}
+
+	return "https://" + bucket.Endpoint
+}
+
+func (s *s3Store) Get(ctx context.Context, key string, opts GetOptions) (*Object, error) {
+	req := &s3.GetObjectInput{
+		Bucket:            &s.bucket.Bucket,
+		Key:               aws.String(withPrefix(s.bucket, key)),
+		Range:             optString(opts.Range),
+		IfMatch:           optString(opts.IfMatch),
+		IfNoneMatch:       optString(opts.IfNoneMatch),
+		IfModifiedSince:   optTime(opts.IfModifiedSince),
+		IfUnmodifiedSince: optTime(opts.IfUnmodifiedSince),
+	}
+
+	out, err := s.client.GetObject(ctx, req)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &Object{
+		ObjectInfo: ObjectInfo{
+			Key:                key,
+			Size:               optInt64(out.ContentLength),
+			AcceptRanges:       aws.ToString(out.AcceptRanges),
+			CacheControl:       aws.ToString(out.CacheControl),
+			ContentDisposition: aws.ToString(out.ContentDisposition),
+			ContentEncoding:    aws.ToString(out.ContentEncoding),
+			ContentLanguage:    aws.ToString(out.ContentLanguage),
+			ContentRange:       aws.ToString(out.ContentRange),
+			ContentType:        aws.ToString(out.ContentType),
+			ETag:               aws.ToString(out.ETag),
+			Expires:            expires(out.ExpiresString, out.Expires),
+			LastModified:       aws.ToTime(out.LastModified),
+			VersionID:          aws.ToString(out.VersionId),
+			Metadata:           out.Metadata,
+		},
+		Body: out.Body,
+	}, nil
+}
+
+// Head takes the same conditions as Get. Ranges are left out, as S3 doesn't
+// hand back the Content-Range of a partial HEAD.
+func (s *s3Store) Head(ctx context.Context, key string, opts GetOptions) (*ObjectInfo, error) {
+	req := &s3.HeadObjectInput{
+		Bucket:            &s.bucket.Bucket,
+		Key:               aws.String(withPrefix(s.bucket, key)),
+		IfMatch:           optString(opts.IfMatch),
+		IfNoneMatch:       optString(opts.IfNoneMatch),
+		IfModifiedSince:   optTime(opts.IfModifiedSince),
+		IfUnmodifiedSince: optTime(opts.IfUnmodifiedSince),
+	}
+
+	out, err := s.client.HeadObject(ctx, req)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &ObjectInfo{
+		Key:                key,
+		Size:               optInt64(out.ContentLength),
+		AcceptRanges:       aws.ToString(out.AcceptRanges),
+		CacheControl:       aws.ToString(out.CacheControl),
+		ContentDisposition: aws.ToString(out.ContentDisposition),
+		ContentEncoding:    aws.ToString(out.ContentEncoding),
+		ContentLanguage:    aws.ToString(out.ContentLanguage),
+		ContentType:        aws.ToString(out.ContentType),
+		ETag:               aws.ToString(out.ETag),
+		Expires:            expires(out.ExpiresString, out.Expires),
+		LastModified:       aws.ToTime(out.LastModified),
+		VersionID:          aws.ToString(out.VersionId),
+		Metadata:           out.Metadata,
+	}, nil
+}
+
+// Put streams the body to S3 in parts, aborting the multipart upload if
+// reading it fails part way or the client hangs up
+func (s *s3Store) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*PutResult, error) {
+	req := &s3.PutObjectInput{
+		Bucket:               &s.bucket.Bucket,
+		Key:                  aws.String(withPrefix(s.bucket, key)),
+		Body:                 body,
+		ACL:                  types.ObjectCannedACL(opts.ACL),
+		StorageClass:         types.StorageClass(opts.StorageClass),
+		ServerSideEncryption: types.ServerSideEncryption(opts.SSE),
+		SSEKMSKeyId:          optString(opts.SSEKMSKeyID),
+		CacheControl:         optString(opts.CacheControl),
+		ContentDisposition:   optString(opts.ContentDisposition),
+		ContentEncoding:      optString(opts.ContentEncoding),
+		ContentLanguage:      optString(opts.ContentLanguage),
+		ContentType:          optString(opts.ContentType),
+		Metadata:             opts.Metadata,
+	}
+
+	out, err := s.uploader.Upload(ctx, req)
+	if err != nil {
+		var failure manager.MultiUploadFailure
+		if errors.As(err, &failure) {
+			s.abort(ctx, *req.Key, failure.UploadID())
+		}
+
+		return nil, storeError(err)
+	}
+
+	return &PutResult{
+		ETag:      aws.ToString(out.ETag),
+		VersionID: aws.ToString(out.VersionID),
+	}, nil
+}
+
+func (s *s3Store) CreateMultipartUpload(ctx context.Context, key string, opts PutOptions) (string, error) {
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               &s.bucket.Bucket,
+		Key:                  aws.String(withPrefix(s.bucket, key)),
+		ACL:                  types.ObjectCannedACL(opts.ACL),
+		StorageClass:         types.StorageClass(opts.StorageClass),
+		ServerSideEncryption: types.ServerSideEncryption(opts.SSE),
+		SSEKMSKeyId:          optString(opts.SSEKMSKeyID),
+		CacheControl:         optString(opts.CacheControl),
+		ContentDisposition:   optString(opts.ContentDisposition),
+		ContentEncoding:      optString(opts.ContentEncoding),
+		ContentLanguage:      optString(opts.ContentLanguage),
+		ContentType:          optString(opts.ContentType),
+		Metadata:             opts.Metadata,
+	})
+	if err != nil {
+		return "", storeError(err)
+	}
+
+	return aws.ToString(out.UploadId), nil
+}
+
+// UploadPart streams the part through without hashing it first, which would
+// mean holding it all, so the payload is sent unsigned
+func (s *s3Store) UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.Reader, size int64) (string, error) {
+	out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        &s.bucket.Bucket,
+		Key:           aws.String(withPrefix(s.bucket, key)),
+		UploadId:      &uploadID,
+		PartNumber:    &partNumber,
+		Body:          body,
+		ContentLength: &size,
+	}, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+	if err != nil {
+		return "", storeError(err)
+	}
+
+	return aws.ToString(out.ETag), nil
+}
+
+func (s *s3Store) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (*PutResult, error) {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(p.PartNumber), ETag: aws.String(p.ETag)})
+	}
+
+	out, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket.Bucket,
+		Key:             aws.String(withPrefix(s.bucket, key)),
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &PutResult{
+		ETag:      aws.ToString(out.ETag),
+		VersionID: aws.ToString(out.VersionId),
+	}, nil
+}
+
+func (s *s3Store) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket.Bucket,
+		Key:      aws.String(withPrefix(s.bucket, key)),
+		UploadId: &uploadID,
+	})
+
+	return storeError(err)
+}
+
+func (s *s3Store) ListParts(ctx context.Context, key, uploadID string, marker, maxParts int32) (*PartsPage, error) {
+	req := &s3.ListPartsInput{
+		Bucket:   &s.bucket.Bucket,
+		Key:      aws.String(withPrefix(s.bucket, key)),
+		UploadId: &uploadID,
+		MaxParts: aws.Int32(maxParts),
+	}
+
+	if marker > 0 {
+		req.PartNumberMarker = aws.String(strconv.FormatInt(int64(marker), 10))
+	}
+
+	out, err := s.client.ListParts(ctx, req)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	page := &PartsPage{IsTruncated: aws.ToBool(out.IsTruncated)}
+
+	if next, err := strconv.ParseInt(aws.ToString(out.NextPartNumberMarker), 10, 32); err == nil {
+		page.NextPartNumberMarker = int32(next)
+	}
+
+	for _, p := range out.Parts {
+		page.Parts = append(page.Parts, Part{
+			PartNumber:   aws.ToInt32(p.PartNumber),
+			ETag:         aws.ToString(p.ETag),
+			Size:         aws.ToInt64(p.Size),
+			LastModified: aws.ToTime(p.LastModified),
+		})
+	}
+
+	return page, nil
+}
+
+func (s *s3Store) PresignGet(ctx context.Context, key string, expiry time.Duration, opts PresignOptions) (string, error) {
+	req := &s3.GetObjectInput{
+		Bucket:                     &s.bucket.Bucket,
+		Key:                        aws.String(withPrefix(s.bucket, key)),
+		ResponseCacheControl:       optString(opts.CacheControl),
+		ResponseContentDisposition: optString(opts.ContentDisposition),
+		ResponseContentEncoding:    optString(opts.ContentEncoding),
+		ResponseContentLanguage:    optString(opts.ContentLanguage),
+		ResponseContentType:        optString(opts.ContentType),
+	}
+
+	if !opts.Expires.IsZero() {
+		req.ResponseExpires = &opts.Expires
+	}
+
+	out, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, req, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", storeError(err)
+	}
+
+	return out.URL, nil
+}
+
+// abort drops the parts of a failed multipart upload, even once the request
+// it was for is cancelled
+func (s *s3Store) abort(ctx context.Context, key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket.Bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	if err != nil {
+		config.Cfg.Logger.Warnf("unable to abort upload %s of %s: %v", uploadID, key, err)
+	}
+}
+
+func (s *s3Store) Delete(ctx context.Context, key, versionID string) (*DeleteResult, error) {
+	out, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:    &s.bucket.Bucket,
+		Key:       aws.String(withPrefix(s.bucket, key)),
+		VersionId: optString(versionID),
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &DeleteResult{
+		VersionID:    aws.ToString(out.VersionId),
+		DeleteMarker: aws.ToBool(out.DeleteMarker),
+	}, nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix, startAfter string, maxKeys int) (*ListPage, error) {
+	return s.list(ctx, prefix, startAfter, maxKeys, aws.String("/"))
+}
+
+func (s *s3Store) ListAll(ctx context.Context, prefix, startAfter string, maxKeys int) (*ListPage, error) {
+	return s.list(ctx, prefix, startAfter, maxKeys, nil)
+}
+
+// list returns a page of a listing, grouping keys into folders at the
+// delimiter if there is one
+func (s *s3Store) list(ctx context.Context, prefix, startAfter string, maxKeys int, delimiter *string) (*ListPage, error) {
+	req := &s3.ListObjectsV2Input{
+		Bucket:    &s.bucket.Bucket,
+		Delimiter: delimiter,
+		MaxKeys:   aws.Int32(int32(maxKeys)),
+		Prefix:    aws.String(withPrefix(s.bucket, prefix)),
+	}
+
+	if startAfter != "" {
+		req.StartAfter = aws.String(withPrefix(s.bucket, startAfter))
+	}
+
+	out, err := s.client.ListObjectsV2(ctx, req)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	page := &ListPage{IsTruncated: aws.ToBool(out.IsTruncated)}
+
+	// Hand back keys as the proxy sees them
+	for _, cp := range out.CommonPrefixes {
+		page.Folders = append(page.Folders, withoutPrefix(s.bucket, aws.ToString(cp.Prefix)))
+	}
+
+	for _, obj := range out.Contents {
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          withoutPrefix(s.bucket, aws.ToString(obj.Key)),
+			Size:         aws.ToInt64(obj.Size),
+			ETag:         aws.ToString(obj.ETag),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+
+	return page, nil
+}
+
+func (s *s3Store) DeleteObjects(ctx context.Context, keys []string) (map[string]error, error) {
+	objects := make([]types.ObjectIdentifier, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(withPrefix(s.bucket, key))})
+	}
+
+	// Quiet answers with the failures only
+	out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: &s.bucket.Bucket,
+		Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	failed := map[string]error{}
+
+	for _, e := range out.Errors {
+		failed[withoutPrefix(s.bucket, aws.ToString(e.Key))] = &Error{
+			Code: aws.ToString(e.Code),
+			Err:  errors.New(aws.ToString(e.Message)), //nolint:goerr113
+		}
+	}
+
+	return failed, nil
+}
+
+// Copy copies an object server side, in parts when it is too large for a
+// single copy
+func (s *s3Store) Copy(ctx context.Context, srcKey, dstKey string) error {
+	info, err := s.Head(ctx, srcKey, GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	segments := strings.Split(s.bucket.Bucket+"/"+withPrefix(s.bucket, srcKey), "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	source := strings.Join(segments, "/")
+
+	// S3 keeps the metadata but not the encryption, storage class or ACL of
+	// the source, so the copy is written like any other upload of its key
+	opts := withUploadSettings(s.bucket, dstKey, copyOptions(info))
+
+	if info.Size > maxCopyObjectSize {
+		return s.multipartCopy(ctx, source, dstKey, info, opts)
+	}
+
+	_, err = s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:               &s.bucket.Bucket,
+		Key:                  aws.String(withPrefix(s.bucket, dstKey)),
+		CopySource:           &source,
+		ACL:                  types.ObjectCannedACL(opts.ACL),
+		StorageClass:         types.StorageClass(opts.StorageClass),
+		ServerSideEncryption: types.ServerSideEncryption(opts.SSE),
+		SSEKMSKeyId:          optString(opts.SSEKMSKeyID),
+	})
+
+	return storeError(err)
+}
+
+// multipartCopy copies an object a range at a time, each range being copied
+// from the version the copy started with
+func (s *s3Store) multipartCopy(ctx context.Context, source, dstKey string, info *ObjectInfo, opts PutOptions) error {
+	uploadID, err := s.CreateMultipartUpload(ctx, dstKey, opts)
+	if err != nil {
+		return err
+	}
+
+	parts := make([]Part, 0, len(copyRanges(info.Size)))
+
+	for i, spec := range copyRanges(info.Size) {
+		out, err := s.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:            &s.bucket.Bucket,
+			Key:               aws.String(withPrefix(s.bucket, dstKey)),
+			UploadId:          &uploadID,
+			PartNumber:        aws.Int32(int32(i + 1)),
+			CopySource:        &source,
+			CopySourceRange:   &spec,
+			CopySourceIfMatch: optString(info.ETag),
+		})
+		if err != nil {
+			s.abort(ctx, withPrefix(s.bucket, dstKey), uploadID)
+
+			return storeError(err)
+		}
+
+		parts = append(parts, Part{PartNumber: int32(i + 1), ETag: aws.ToString(out.CopyPartResult.ETag)})
+	}
+
+	if _, err := s.CompleteMultipartUpload(ctx, dstKey, uploadID, parts); err != nil {
+		s.abort(ctx, withPrefix(s.bucket, dstKey), uploadID)
+
+		return err
+	}
+
+	return nil
+}
+
+// copyRanges splits an object into the byte ranges it is copied in
+func copyRanges(size int64) []string {
+	maxParts := int64(manager.MaxUploadParts)
+	partSize := max(copyPartSize, (size+maxParts-1)/maxParts)
+
+	var ranges []string
+
+	for start := int64(0); start < size; start += partSize {
+		ranges = append(ranges, fmt.Sprintf("bytes=%d-%d", start, min(start+partSize, size)-1))
+	}
+
+	return ranges
+}
+
+// storeError translates an SDK error into an Error with the S3 code and
+// status, so that callers don't need to know about the SDK
+func storeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	status := 0
+
+	var info *ObjectInfo
+
+	var rerr *awshttp.ResponseError
+	if errors.As(err, &rerr) {
+		status = rerr.HTTPStatusCode()
+
+		if status == http.StatusNotModified && rerr.Response != nil && rerr.Response.Response != nil {
+			info = validators(rerr.Response.Header)
+		}
+	}
+
+	var aerr smithy.APIError
+	if errors.As(err, &aerr) {
+		return &Error{Code: aerr.ErrorCode(), Status: status, Err: err, Info: info}
+	}
+
+	// The request never got an answer
+	var serr *smithyhttp.RequestSendError
+	if errors.As(err, &serr) {
+		return &Error{Code: errCodeRequestError, Err: err}
+	}
+
+	return err
+}
+
+// validators reads the headers S3 repeats in a 304 answer
+func validators(h http.Header) *ObjectInfo {
+	info := &ObjectInfo{
+		ETag:         h.Get("ETag"),
+		CacheControl: h.Get("Cache-Control"),
+		Expires:      h.Get("Expires"),
+	}
+
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+
+	return info
+}
+
+func optString(v string) *string {
+	if v == "" {
+		return nil
+	}
+
+	return &v
+}
+
+func optTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func optInt64(v *int64) int64 {
+	if v == nil {
+		return -1
+	}
+
+	return *v
+}
+
+// expires prefers the raw Expires header, which may not be a valid date
+func expires(raw *string, t *time.Time) string {
+	if raw != nil {
+		return *raw
+	}
+
+	if t != nil {
+		return t.UTC().Format(http.TimeFormat)
+	}
+
+	return ""
+}
@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+func TestStoreError(t *testing.T) {
+	err := storeError(&smithy.OperationError{
+		OperationName: "HeadObject",
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{
+					StatusCode: http.StatusNotModified,
+					Header:     http.Header{"Etag": {`"abc"`}, "Last-Modified": {"Sat, 17 Oct 2026 18:00:00 GMT"}},
+				}},
+				Err: &smithy.GenericAPIError{Code: errCodeNotModified},
+			},
+		},
+	})
+
+	var serr *Error
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, errCodeNotModified, serr.Code)
+	assert.Equal(t, http.StatusNotModified, serr.Status)
+	require.NotNil(t, serr.Info)
+	assert.Equal(t, `"abc"`, serr.Info.ETag)
+	assert.Equal(t, 2026, serr.Info.LastModified.Year())
+
+	status, ok := conditionalStatus(err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotModified, status)
+
+	err = storeError(&smithyhttp.RequestSendError{Err: context.Canceled})
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, errCodeRequestError, serr.Code)
+
+	status, _ = toHTTPError(err)
+	assert.Equal(t, statusClientClosedRequest, status)
+
+	other := errors.New("other") //nolint:goerr113
+	assert.Equal(t, other, storeError(other))
+	assert.NoError(t, storeError(nil))
+}
+
+func TestCopyRanges(t *testing.T) {
+	assert.Equal(t, []string{"bytes=0-536870911", "bytes=536870912-599999999"}, copyRanges(600_000_000))
+
+	// 5 TiB, the largest object, takes no more than the parts S3 allows
+	ranges := copyRanges(5 << 40)
+	assert.Len(t, ranges, 10000)
+	assert.True(t, strings.HasSuffix(ranges[len(ranges)-1], fmt.Sprintf("-%d", int64(5<<40)-1)))
+}
+
+func TestCopyUploadSettings(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		size    int64
+		created http.Header
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		q := r.URL.Query()
+
+		switch {
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("ETag", `"src"`)
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			created = r.Header.Clone()
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPost:
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"dst"</ETag></CompleteMultipartUploadResult>`)
+		case q.Has("partNumber"):
+			fmt.Fprint(w, `<CopyPartResult><ETag>"part"</ETag></CopyPartResult>`)
+		default:
+			created = r.Header.Clone()
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"dst"</ETag></CopyObjectResult>`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	s := newS3Store(&config.Bucket{
+		Bucket:   "bucket",
+		Endpoint: srv.URL,
+		AWSConfig: aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		},
+		UploadSettings: config.UploadSettings{StorageClass: "STANDARD_IA", SSE: "aws:kms", SSEKMSKeyID: "alias/store"},
+	})
+
+	// Objects copied in a single request and in parts are written alike
+	for _, n := range []int64{10, maxCopyObjectSize + 1} {
+		mu.Lock()
+		size, created = n, nil
+		mu.Unlock()
+
+		require.NoError(t, s.Copy(context.Background(), "src.txt", "dst.txt"))
+
+		mu.Lock()
+		require.NotNil(t, created, "size %d", n)
+		assert.Equal(t, "STANDARD_IA", created.Get("x-amz-storage-class"), "size %d", n)
+		assert.Equal(t, "aws:kms", created.Get("x-amz-server-side-encryption"), "size %d", n)
+		assert.Equal(t, "alias/store", created.Get("x-amz-server-side-encryption-aws-kms-key-id"), "size %d", n)
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,220 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// Store is a backend objects are read from and written to. Keys are as the
+// proxy sees them, each store maps them onto its own layout.
+type Store interface {
+	// Get returns an object, or the part of it asked for
+	Get(ctx context.Context, key string, opts GetOptions) (*Object, error)
+	// Head returns the metadata of an object without its body
+	Head(ctx context.Context, key string, opts GetOptions) (*ObjectInfo, error)
+	// Put writes an object from a body of any size
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*PutResult, error)
+	// Delete removes an object, or the given version of it
+	Delete(ctx context.Context, key, versionID string) (*DeleteResult, error)
+	// List returns a page of the objects and folders directly under a prefix
+	List(ctx context.Context, prefix, startAfter string, maxKeys int) (*ListPage, error)
+	// ListAll returns a page of the objects under a prefix however deep,
+	// without folders
+	ListAll(ctx context.Context, prefix, startAfter string, maxKeys int) (*ListPage, error)
+	// Copy copies an object to another key in the same store
+	Copy(ctx context.Context, srcKey, dstKey string) error
+}
+
+// MultipartStore is a Store that can also take objects in parts uploaded
+// separately, as S3 does
+type MultipartStore interface {
+	// CreateMultipartUpload starts an upload, returning its ID
+	CreateMultipartUpload(ctx context.Context, key string, opts PutOptions) (string, error)
+	// UploadPart writes a part of the given size, returning its ETag
+	UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.Reader, size int64) (string, error)
+	// CompleteMultipartUpload makes the object from the given parts
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (*PutResult, error)
+	// AbortMultipartUpload drops an upload and its parts
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+	// ListParts returns a page of the parts of an upload, after the marker
+	ListParts(ctx context.Context, key, uploadID string, marker, maxParts int32) (*PartsPage, error)
+}
+
+// Part is a part of a multipart upload
+type Part struct {
+	PartNumber   int32
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+// PartsPage is a page of the parts of a multipart upload
+type PartsPage struct {
+	Parts                []Part
+	NextPartNumberMarker int32
+	IsTruncated          bool
+}
+
+// BatchDeleteStore is a Store that can also delete many objects in one
+// request, as S3 does
+type BatchDeleteStore interface {
+	// DeleteObjects removes up to maxDeleteBatch objects, returning why each
+	// of the ones that couldn't be wasn't
+	DeleteObjects(ctx context.Context, keys []string) (map[string]error, error)
+}
+
+// maxDeleteBatch is the most objects S3 deletes in one request
+const maxDeleteBatch = 1000
+
+// PresignStore is a Store that can hand out URLs reading an object from it
+// directly, for a while
+type PresignStore interface {
+	PresignGet(ctx context.Context, key string, expiry time.Duration, opts PresignOptions) (string, error)
+}
+
+// PresignOptions override the headers of the object the store answers a
+// presigned GET with, when set
+type PresignOptions struct {
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentType        string
+	Expires            time.Time
+}
+
+// GetOptions are the range and conditions of a read
+type GetOptions struct {
+	Range             string
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+}
+
+// PutOptions are how an object is written
+type PutOptions struct {
+	ACL          string
+	StorageClass string
+	SSE          string
+	SSEKMSKeyID  string
+
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentType        string
+	Metadata           map[string]string
+}
+
+// copyOptions writes a copy of an object with the same metadata
+func copyOptions(info *ObjectInfo) PutOptions {
+	return PutOptions{
+		CacheControl:       info.CacheControl,
+		ContentDisposition: info.ContentDisposition,
+		ContentEncoding:    info.ContentEncoding,
+		ContentLanguage:    info.ContentLanguage,
+		ContentType:        info.ContentType,
+		Metadata:           info.Metadata,
+	}
+}
+
+// ObjectInfo is the metadata of an object, as sent in response headers
+type ObjectInfo struct {
+	Key string
+	// Size is the length of the body being sent, -1 if it isn't known
+	Size               int64
+	AcceptRanges       string
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentRange       string
+	ContentType        string
+	ETag               string
+	Expires            string
+	LastModified       time.Time
+	VersionID          string
+	Metadata           map[string]string
+}
+
+// Object is an object with its body, which the caller closes
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+}
+
+// PutResult describes a written object
+type PutResult struct {
+	ETag      string
+	VersionID string
+}
+
+// DeleteResult describes a deleted object
+type DeleteResult struct {
+	VersionID    string
+	DeleteMarker bool
+}
+
+// ListPage is a page of a listing, keys being relative to the store root
+type ListPage struct {
+	Folders     []string
+	Objects     []ObjectInfo
+	IsTruncated bool
+}
+
+// Error is a failed store request, carrying the S3 error code and the
+// status the backend answered with, if any
+type Error struct {
+	Code   string
+	Status int
+	Err    error
+	// Info holds the validators of the object a NotModified answer is
+	// about, which the 304 has to repeat
+	Info *ObjectInfo
+}
+
+func (e *Error) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s (%d): %v", e.Code, e.Status, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = map[*config.Bucket]Store{}
+)
+
+// storeFor returns the store of a configured bucket, creating it on first use
+func storeFor(bucket *config.Bucket) Store {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if s, ok := stores[bucket]; ok {
+		return s
+	}
+
+	var s Store
+
+	switch bucket.Type {
+	case config.StoreTypeFilesystem:
+		s = newFSStore(bucket)
+	default:
+		s = newS3Store(bucket)
+	}
+
+	stores[bucket] = s
+
+	return s
+}
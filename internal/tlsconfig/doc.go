@@ -0,0 +1,3 @@
+// Package tlsconfig builds the TLS config the proxy serves HTTPS with,
+// reloading its certificate and client CA bundle when they change on disk
+package tlsconfig
@@ -0,0 +1,256 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// Client certificate modes
+const (
+	// ClientAuthRequire refuses connections without a verified certificate
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies a certificate if the client sends one
+	ClientAuthOptional = "optional"
+)
+
+// reloadCheckInterval is how often the files are checked for changes
+var reloadCheckInterval = time.Second
+
+var (
+	// ErrUnknownVersion is returned when a TLS version isn't recognised
+	ErrUnknownVersion = errors.New("unknown TLS version")
+	// ErrUnknownCipherSuite is returned when a cipher suite isn't one Go
+	// considers secure
+	ErrUnknownCipherSuite = errors.New("unknown or insecure cipher suite")
+	// ErrUnknownClientAuth is returned when a client certificate mode isn't
+	// recognised
+	ErrUnknownClientAuth = errors.New("unknown client certificate mode")
+	// ErrNoCACerts is returned when a CA bundle holds no certificates
+	ErrNoCACerts = errors.New("no certificates in CA bundle")
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion maps a version like 1.2 onto its TLS constant, an empty
+// version being the default of 1.2
+func ParseVersion(v string) (uint16, error) {
+	if v == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	if version, ok := versions[v]; ok {
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownVersion, v)
+}
+
+// ParseCipherSuites maps suite names onto their IDs. Only TLS 1.2 and
+// older use them, and none means Go's defaults.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownCipherSuite, name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven, nil
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownClientAuth, mode)
+}
+
+// New builds the TLS config to serve with. HTTP/2 is offered, and client
+// certificates are verified against the CA bundle if one is given. The
+// certificate, key and CA bundle are reloaded whenever their size or
+// modification time changes, keeping the previous ones if they don't load.
+func New(t config.TLS, l *zap.SugaredLogger) (*tls.Config, error) {
+	minVersion, err := ParseVersion(t.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := ParseCipherSuites(t.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if t.ClientCAFile != "" {
+		if base.ClientAuth, err = parseClientAuth(t.ClientAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &reloader{tls: t, base: base, logger: l}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return r.config(), nil
+	}
+
+	return cfg, nil
+}
+
+// fileStamp tells a file has changed
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// reloader holds the config built from the current certificate and CA
+// bundle, rebuilding it when they change
+type reloader struct {
+	tls    config.TLS
+	base   *tls.Config
+	logger *zap.SugaredLogger
+
+	mu      sync.RWMutex
+	current *tls.Config
+	stamps  map[string]fileStamp
+	checked time.Time
+}
+
+func (r *reloader) files() []string {
+	files := []string{r.tls.CertFile, r.tls.KeyFile}
+	if r.tls.ClientCAFile != "" {
+		files = append(files, r.tls.ClientCAFile)
+	}
+
+	return files
+}
+
+// config returns the current config, reloading it first if a file changed
+func (r *reloader) config() *tls.Config {
+	r.mu.RLock()
+	current, fresh := r.current, time.Since(r.checked) < reloadCheckInterval
+	r.mu.RUnlock()
+
+	if fresh {
+		return current
+	}
+
+	r.mu.Lock()
+	r.checked = time.Now()
+	stamps := r.stamps
+	r.mu.Unlock()
+
+	changed := false
+
+	for _, f := range r.files() {
+		// Stat follows symlinks, so atomically swapped mounts are picked up too
+		info, err := os.Stat(f)
+		if err != nil {
+			r.logger.Errorf("unable to stat %s, keeping the previous TLS config: %v", f, err)
+
+			return current
+		}
+
+		if s := stamps[f]; !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return current
+	}
+
+	if err := r.load(); err != nil {
+		r.logger.Errorf("unable to reload TLS certificate, keeping the previous one: %v", err)
+
+		return current
+	}
+
+	r.logger.Infof("reloaded TLS certificate %s", r.tls.CertFile)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current
+}
+
+func (r *reloader) load() error {
+	stamps := map[string]fileStamp{}
+
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+
+		stamps[f] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.tls.CertFile, r.tls.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cfg := r.base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+
+	if r.tls.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.tls.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %s", ErrNoCACerts, r.tls.ClientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+	}
+
+	r.mu.Lock()
+	r.current = cfg
+	r.stamps = stamps
+	r.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/packethost/aws-s3-proxy/internal/config"
+)
+
+// writeCert writes a self-signed certificate and its key for the name
+func writeCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func servedName(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+
+	current, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(current.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+
+	return leaf.Subject.CommonName
+}
+
+func TestParse(t *testing.T) {
+	v, err := ParseVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+
+	v, err = ParseVersion("1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+
+	_, err = ParseVersion("3")
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, suites)
+
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.ErrorIs(t, err, ErrUnknownCipherSuite)
+}
+
+func TestReload(t *testing.T) {
+	interval := reloadCheckInterval
+	reloadCheckInterval = 0
+
+	t.Cleanup(func() { reloadCheckInterval = interval })
+
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first")
+
+	cfg, err := New(config.TLS{CertFile: certFile, KeyFile: keyFile}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	assert.Contains(t, cfg.NextProtos, "h2")
+	assert.Equal(t, "first", servedName(t, cfg))
+
+	writeCert(t, dir, "second")
+	// make sure the change shows even on coarse mtimes
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "second", servedName(t, cfg))
+
+	// a broken certificate keeps the previous one
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Equal(t, "second", servedName(t, cfg))
+}